@@ -0,0 +1,122 @@
+// irctrace converts a timestamped raw IRC log into an anonymized trace
+// which can be replayed by throughput -trace.
+//
+// Each input line consists of a timestamp (RFC 3339 or fractional Unix
+// seconds) followed by the raw IRC message as seen by a client, e.g.:
+//
+//	1471096246.123 :alice!a@example.net PRIVMSG #robustirc :hello
+//
+// Only messages with a user prefix are recorded. Nicknames and channel
+// names are replaced by numbers, message contents are discarded (only
+// their size is kept).
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/trace"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+var (
+	output = flag.String("output",
+		"",
+		"Path to write the trace to. Defaults to stdout")
+
+	commands = flag.String("commands",
+		"PRIVMSG,NOTICE",
+		"Comma-separated list of IRC commands to record. Empty records all commands")
+)
+
+func parseTimestamp(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Unix(0, int64(secs*1e9)), nil
+}
+
+func convert(r io.Reader, w *trace.Writer, record map[string]bool) (int, error) {
+	anonymizer := trace.NewAnonymizer()
+	var last time.Time
+	var events int
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		parts := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		t, err := parseTimestamp(parts[0])
+		if err != nil {
+			return events, fmt.Errorf("line %d: %v", line, err)
+		}
+		if t.Before(last) {
+			return events, fmt.Errorf("line %d: timestamp %v is before the previous timestamp %v", line, t, last)
+		}
+		last = t
+		msg := irc.ParseMessage(parts[1])
+		if msg == nil || msg.Prefix == nil || !msg.Prefix.IsHostmask() {
+			continue
+		}
+		if len(record) > 0 && !record[msg.Command] {
+			continue
+		}
+		if err := w.Write(anonymizer.Event(t, msg.Prefix.Name, msg)); err != nil {
+			return events, err
+		}
+		events++
+	}
+	return events, scanner.Err()
+}
+
+func main() {
+	flag.Parse()
+
+	record := make(map[string]bool)
+	for _, command := range strings.Split(*commands, ",") {
+		if command = strings.TrimSpace(command); command != "" {
+			record[strings.ToUpper(command)] = true
+		}
+	}
+
+	in := os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	bufw := bufio.NewWriter(out)
+
+	events, err := convert(in, trace.NewWriter(bufw), record)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := bufw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("recorded %d events", events)
+}
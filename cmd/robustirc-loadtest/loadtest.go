@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -21,11 +22,10 @@ import (
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/kubernetes/scheme"
 
+	"github.com/robustirc/benchmark/internal/kube"
 	"github.com/stapelberg/loggedexec"
-
-	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
 var (
@@ -168,7 +168,71 @@ func buildContainers(dir, name string) error {
 	return loggedexec.Command("gcloud", "docker", "--", "push", gcrPath).Run()
 }
 
-func runThroughputBenchmark(client *kubernetes.Clientset) error {
+// gitRevision returns the git revision of the repository in dir, with a
+// -dirty suffix if it contains uncommitted changes.
+func gitRevision(dir string) (string, error) {
+	// TODO: use loggedexec once Output is supported
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: git rev-parse: %v", dir, err)
+	}
+	revision := strings.TrimSpace(string(out))
+	cmd = exec.Command("git", "status", "--porcelain")
+	cmd.Dir = dir
+	out, err = cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: git status: %v", dir, err)
+	}
+	if len(bytes.TrimSpace(out)) > 0 {
+		revision += "-dirty"
+	}
+	return revision, nil
+}
+
+// throughputInputs returns the flags which identify this load test in
+// the report and metrics of throughput: the revisions of the benchmark
+// and of RobustIRC (which are built into the containers) and a run ID.
+// throughput itself hashes its configuration.
+func throughputInputs() ([]string, error) {
+	benchmarkRevision, err := gitRevision(".")
+	if err != nil {
+		return nil, err
+	}
+	robustircRevision, err := gitRevision("../robustirc")
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"-run_id=" + *deploymentName + "-" + time.Now().UTC().Format("20060102-150405"),
+		"-benchmark_revision=" + benchmarkRevision,
+		"-robustirc_revision=" + robustircRevision,
+		"-labels=gcp_project=" + *gcpProjectName,
+	}, nil
+}
+
+// createThroughputPod creates the pod of deployments/throughput.pod.yaml,
+// with inputs appended to the arguments of throughput.
+func createThroughputPod(client *kubernetes.Clientset, inputs []string) error {
+	b, err := ioutil.ReadFile("deployments/throughput.pod.yaml")
+	if err != nil {
+		return err
+	}
+	obj, _, err := scheme.Codecs.UniversalDeserializer().Decode(b, nil, nil)
+	if err != nil {
+		return err
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || len(pod.Spec.Containers) != 1 {
+		return fmt.Errorf("deployments/throughput.pod.yaml: expected a pod with one container")
+	}
+	pod.Spec.Containers[0].Args = append(pod.Spec.Containers[0].Args, inputs...)
+	_, err = client.CoreV1().Pods(corev1.NamespaceDefault).Create(pod)
+	return err
+}
+
+func runThroughputBenchmark(client *kubernetes.Clientset, inputs []string) error {
 	if _, err := client.CoreV1().Pods(corev1.NamespaceDefault).Get("throughput", metav1.GetOptions{}); err == nil {
 		log.Printf("deleting pod")
 		if err := client.CoreV1().Pods(corev1.NamespaceDefault).Delete("throughput", &metav1.DeleteOptions{}); err != nil {
@@ -198,12 +262,17 @@ func runThroughputBenchmark(client *kubernetes.Clientset) error {
 		return err
 	}
 
-	// TODO: replace robustirc-loadtest with *gcpProjectName
-	cmd := loggedexec.Command("kubectl", "create", "-f", "deployments/throughput.pod.yaml")
+	// The service account of the pod, see -fault_actuator=kubernetes.
+	cmd := loggedexec.Command("kubectl", "apply", "-f", "deployments/throughput.rbac.yaml")
 	if err := cmd.Run(); err != nil {
 		return err
 	}
 
+	// TODO: replace robustirc-loadtest with *gcpProjectName
+	if err := createThroughputPod(client, inputs); err != nil {
+		return err
+	}
+
 	cmd = loggedexec.Command("kubectl", "create", "-f", "deployments/throughput.svc.yaml")
 	return cmd.Run()
 }
@@ -330,6 +399,7 @@ func loadtest() error {
 		"deployments/cluster.yaml",
 		"deployments/kubernetes.yaml",
 		"deployments/throughput.pod.yaml",
+		"deployments/throughput.rbac.yaml",
 		"deployments/throughput.svc.yaml",
 
 		"../robustirc/contrib/grafana/robustirc.json",
@@ -342,6 +412,14 @@ func loadtest() error {
 		}
 	}
 
+	// Determine the inputs before building, so that they describe what
+	// is built.
+	inputs, err := throughputInputs()
+	if err != nil {
+		return err
+	}
+	log.Printf("throughput inputs: %s", strings.Join(inputs, " "))
+
 	// Start building and pushing docker containers in parallel and asynchronously.
 	var buildWg errgroup.Group
 	buildWg.Go(func() error { return buildContainers(".", "robustirc/benchmark") })
@@ -369,15 +447,7 @@ func loadtest() error {
 		return err
 	}
 
-	kConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		clientcmd.NewDefaultClientConfigLoadingRules(),
-		&clientcmd.ConfigOverrides{})
-	kubeConfig, err := kConfig.ClientConfig()
-	if err != nil {
-		return err
-	}
-
-	kubeClient, err := kubernetes.NewForConfig(kubeConfig)
+	kubeClient, err := kube.NewClient()
 	if err != nil {
 		return err
 	}
@@ -394,7 +464,7 @@ func loadtest() error {
 		return err
 	}
 
-	if err := runThroughputBenchmark(kubeClient); err != nil {
+	if err := runThroughputBenchmark(kubeClient, inputs); err != nil {
 		return err
 	}
 
@@ -538,7 +608,6 @@ func main() {
 		return
 	}
 
-	// TODO: figure out the inputs to this, i.e. possibly a hash of the config, and a hash of the binary (distributed via docker), compile a report
 	log.Printf("running loadtest\n")
 
 	if err := loadtest(); err != nil {
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// baselineReport is the report loaded from -baseline, if any.
+var baselineReport *report
+
+// loadBaseline reads a JSON report (see -report) of a previous run.
+func loadBaseline(filename string) (*report, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var r report
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(r.Series) == 0 {
+		return nil, fmt.Errorf("%s: report contains no measurements", filename)
+	}
+	return &r, nil
+}
+
+type metricComparison struct {
+	Metric   string  `json:"metric"`
+	Baseline float64 `json:"baseline"`
+	Current  float64 `json:"current"`
+	// Change is relative to Baseline, e.g. 0.1 for +10%. It is 1 if
+	// Baseline is 0 and Current is not.
+	Change float64 `json:"change"`
+	// PValue is the p-value of the significance test, if there was
+	// enough data to run one.
+	PValue *float64 `json:"p_value,omitempty"`
+	// Test describes what PValue was computed on.
+	Test string `json:"test,omitempty"`
+
+	Regression  bool `json:"regression"`
+	Improvement bool `json:"improvement"`
+}
+
+type baselineComparison struct {
+	// BaselineStarted identifies the baseline run.
+	BaselineStarted time.Time          `json:"baseline_started"`
+	Tolerance       float64            `json:"tolerance"`
+	Significance    float64            `json:"significance"`
+	Metrics         []metricComparison `json:"metrics"`
+	Regressions     int                `json:"regressions"`
+}
+
+// compareReports compares current to baseline. A metric regressed (or
+// improved) if it changed for the worse (or better) by more than
+// tolerance and, if a significance test could be run, its p-value is
+// below significance.
+func compareReports(baseline, current *report, tolerance, significance float64) *baselineComparison {
+	c := &baselineComparison{
+		BaselineStarted: baseline.Started,
+		Tolerance:       tolerance,
+		Significance:    significance,
+	}
+	add := func(m metricComparison, higherIsBetter bool) {
+		switch {
+		case m.Baseline != 0:
+			m.Change = (m.Current - m.Baseline) / m.Baseline
+		case m.Current != 0:
+			m.Change = 1
+		}
+		significant := m.PValue == nil || *m.PValue < significance
+		worse := m.Change > tolerance
+		better := m.Change < -tolerance
+		if higherIsBetter {
+			worse, better = better, worse
+		}
+		m.Regression = worse && significant
+		m.Improvement = better && significant
+		if m.Regression {
+			c.Regressions++
+		}
+		c.Metrics = append(c.Metrics, m)
+	}
+
+	rates := func(r *report) (sent, received, p99 []float64) {
+		for _, s := range r.Series {
+			sent = append(sent, float64(s.Sent))
+			received = append(received, float64(s.Received))
+			if s.LatencyP99 > 0 {
+				p99 = append(p99, s.LatencyP99)
+			}
+		}
+		return sent, received, p99
+	}
+	baseSent, baseReceived, baseP99 := rates(baseline)
+	curSent, curReceived, curP99 := rates(current)
+	baseSentRate, baseReceivedRate := baseline.meanRates()
+	curSentRate, curReceivedRate := current.meanRates()
+
+	add(metricComparison{
+		Metric:   "sent_rate",
+		Baseline: baseSentRate,
+		Current:  curSentRate,
+		PValue:   mannWhitneyU(baseSent, curSent),
+		Test:     "Mann-Whitney U on msg/s per second",
+	}, true)
+	add(metricComparison{
+		Metric:   "received_rate",
+		Baseline: baseReceivedRate,
+		Current:  curReceivedRate,
+		PValue:   mannWhitneyU(baseReceived, curReceived),
+		Test:     "Mann-Whitney U on msg/s per second",
+	}, true)
+	// Only the quantiles of the whole run are recorded, so all latency
+	// quantiles are tested on the per-second p99 latencies.
+	latencyP := mannWhitneyU(baseP99, curP99)
+	for _, q := range reportQuantiles {
+		name := quantileName(q)
+		add(metricComparison{
+			Metric:   name + "_latency",
+			Baseline: baseline.Latency.Quantiles[name],
+			Current:  current.Latency.Quantiles[name],
+			PValue:   latencyP,
+			Test:     "Mann-Whitney U on p99 latency per second",
+		}, false)
+	}
+	add(metricComparison{
+		Metric:   "loss_ratio",
+		Baseline: sloMetrics["loss_ratio"](baseline),
+		Current:  sloMetrics["loss_ratio"](current),
+		PValue: twoProportionZ(
+			baseline.Accounting.Lost, baseline.Accounting.Sent,
+			current.Accounting.Lost, current.Accounting.Sent),
+		Test: "two-proportion z-test",
+	}, false)
+	return c
+}
+
+func (c *baselineComparison) logReport() {
+	for _, m := range c.Metrics {
+		if m.Regression {
+			log.Printf("Regression compared to baseline: %s %g → %g (%+.1f%%)", m.Metric, m.Baseline, m.Current, m.Change*100)
+		}
+	}
+	log.Printf("%d regressions compared to baseline (tolerance %.1f%%, significance level %g)", c.Regressions, c.Tolerance*100, c.Significance)
+}
+
+// mannWhitneyU returns the two-sided p-value of the Mann-Whitney U test
+// of a and b (normal approximation, with tie and continuity correction),
+// or nil if there are too few samples.
+func mannWhitneyU(a, b []float64) *float64 {
+	n1, n2 := len(a), len(b)
+	if n1 < 2 || n2 < 2 {
+		return nil
+	}
+	type sample struct {
+		value float64
+		first bool
+	}
+	samples := make([]sample, 0, n1+n2)
+	for _, v := range a {
+		samples = append(samples, sample{v, true})
+	}
+	for _, v := range b {
+		samples = append(samples, sample{v, false})
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].value < samples[j].value })
+
+	var rankSum, ties float64
+	for i := 0; i < len(samples); {
+		j := i
+		for j < len(samples) && samples[j].value == samples[i].value {
+			j++
+		}
+		// Samples i to j-1 share the average of the ranks i+1 to j.
+		rank := float64(i+1+j) / 2
+		for k := i; k < j; k++ {
+			if samples[k].first {
+				rankSum += rank
+			}
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+
+	fn1, fn2 := float64(n1), float64(n2)
+	n := fn1 + fn2
+	u := rankSum - fn1*(fn1+1)/2
+	mean := fn1 * fn2 / 2
+	sigma := math.Sqrt(fn1 * fn2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	p := 1.0
+	if sigma > 0 {
+		z := math.Max(math.Abs(u-mean)-0.5, 0) / sigma
+		p = math.Erfc(z / math.Sqrt2)
+	}
+	return &p
+}
+
+// twoProportionZ returns the two-sided p-value of the z-test for the
+// proportions x1/n1 and x2/n2, or nil if a sample is empty.
+func twoProportionZ(x1, n1, x2, n2 uint64) *float64 {
+	if n1 == 0 || n2 == 0 {
+		return nil
+	}
+	p1 := float64(x1) / float64(n1)
+	p2 := float64(x2) / float64(n2)
+	pooled := float64(x1+x2) / float64(n1+n2)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(n1) + 1/float64(n2)))
+	p := 1.0
+	if se > 0 {
+		p = math.Erfc(math.Abs(p1-p2) / se / math.Sqrt2)
+	}
+	return &p
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+func TestMannWhitneyU(t *testing.T) {
+	if p := mannWhitneyU([]float64{1}, []float64{2, 3}); p != nil {
+		t.Errorf("mannWhitneyU with one sample: got %v, want nil", *p)
+	}
+	// U = 0, z = (12.5 - 0.5) / sqrt(25/12 * 11)
+	p := mannWhitneyU([]float64{1, 2, 3, 4, 5}, []float64{6, 7, 8, 9, 10})
+	if want := 0.01219; p == nil || math.Abs(*p-want) > 1e-4 {
+		t.Errorf("mannWhitneyU: got %v, want %v", p, want)
+	}
+	p = mannWhitneyU([]float64{1, 2, 3, 4, 5}, []float64{5, 4, 3, 2, 1})
+	if p == nil || *p != 1 {
+		t.Errorf("mannWhitneyU of identical samples: got %v, want 1", p)
+	}
+}
+
+func TestCompareReports(t *testing.T) {
+	newReport := func(received []uint64, p99 float64, lost uint64) *report {
+		r := &report{
+			Latency:    latencyReport{Quantiles: map[string]float64{"p99": p99}},
+			Accounting: load.AccountingSummary{Sent: 100000, Lost: lost},
+		}
+		for _, n := range received {
+			r.Series = append(r.Series, load.Second{Sent: 2000, Received: n, LatencyP99: p99 + float64(n%7)})
+		}
+		return r
+	}
+	baseline := newReport([]uint64{2000, 2010, 1990, 2005, 1995, 2000, 2003, 1998}, 100, 0)
+
+	c := compareReports(baseline, baseline, 0.05, 0.05)
+	if c.Regressions != 0 {
+		t.Errorf("compareReports(baseline, baseline): got %d regressions, want 0", c.Regressions)
+	}
+
+	current := newReport([]uint64{1500, 1510, 1490, 1505, 1495, 1500, 1503, 1498}, 300, 500)
+	c = compareReports(baseline, current, 0.05, 0.05)
+	regressed := make(map[string]bool)
+	for _, m := range c.Metrics {
+		regressed[m.Metric] = m.Regression
+	}
+	for _, metric := range []string{"received_rate", "p99_latency", "loss_ratio"} {
+		if !regressed[metric] {
+			t.Errorf("compareReports: %s did not regress", metric)
+		}
+	}
+	if regressed["sent_rate"] {
+		t.Errorf("compareReports: sent_rate unexpectedly regressed")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+// canceledExitCode is the exit code of throughput when the run was
+// canceled (by -max_duration or a signal) and only a partial report was
+// written.
+const canceledExitCode = 4
+
+// sessionQuitTimeout bounds how long deleting all sessions (with a QUIT
+// message) may take when a run ends, e.g. when the network is down.
+const sessionQuitTimeout = 10 * time.Second
+
+// runCancellation describes why the run context was canceled.
+type runCancellation struct {
+	mu     sync.Mutex
+	signal os.Signal
+}
+
+var cancellation runCancellation
+
+// reason returns why ctx was canceled, or the empty string if it was
+// not.
+func (c *runCancellation) reason(ctx context.Context) string {
+	switch ctx.Err() {
+	case nil:
+		return ""
+	case context.DeadlineExceeded:
+		return fmt.Sprintf("-max_duration of %v exceeded", *maxDuration)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.signal != nil {
+		return fmt.Sprintf("received %v", c.signal)
+	}
+	return ctx.Err().Error()
+}
+
+// runContext returns the context of the run, which is canceled once
+// -max_duration passed or SIGINT or SIGTERM is received. A second
+// signal exits immediately.
+func runContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if *maxDuration > 0 {
+		var cancelTimeout context.CancelFunc
+		ctx, cancelTimeout = context.WithTimeout(ctx, *maxDuration)
+		cancelParent := cancel
+		cancel = func() {
+			cancelTimeout()
+			cancelParent()
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		cancellation.mu.Lock()
+		cancellation.signal = sig
+		cancellation.mu.Unlock()
+		log.Printf("Received %v, canceling the run (send it again to exit immediately)", sig)
+		cancel()
+		sig = <-signals
+		log.Printf("Received %v again, exiting", sig)
+		exit(canceledExitCode)
+	}()
+	return ctx, cancel
+}
+
+var (
+	exitHooksMu   sync.Mutex
+	exitHooks     []func()
+	exitHooksOnce sync.Once
+)
+
+// onExit registers fn to be run when throughput exits, including via
+// fatal and the second signal, e.g. to restore the network config.
+// Hooks run in reverse order of registration.
+func onExit(fn func()) {
+	exitHooksMu.Lock()
+	defer exitHooksMu.Unlock()
+	exitHooks = append(exitHooks, fn)
+}
+
+// runExitHooks runs the hooks registered with onExit. Subsequent calls
+// have no effect.
+func runExitHooks() {
+	exitHooksOnce.Do(func() {
+		exitHooksMu.Lock()
+		hooks := exitHooks
+		exitHooksMu.Unlock()
+		for idx := len(hooks) - 1; idx >= 0; idx-- {
+			hooks[idx]()
+		}
+	})
+}
+
+// exit runs the exit hooks and exits with code.
+func exit(code int) {
+	runExitHooks()
+	os.Exit(code)
+}
+
+// fatal is like log.Fatal, but runs the exit hooks.
+func fatal(v ...interface{}) {
+	log.Print(v...)
+	exit(1)
+}
+
+// fatalf is like log.Fatalf, but runs the exit hooks.
+func fatalf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+	exit(1)
+}
+
+// quitSessions deletes all sessions of r, so that they send QUIT
+// instead of timing out.
+func quitSessions(r *load.Runner) {
+	ctx, cancel := context.WithTimeout(context.Background(), sessionQuitTimeout)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		log.Printf("Not all sessions quit within %v: %v", sessionQuitTimeout, err)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/robustirc/benchmark/internal/robustclient"
+)
+
+var (
+	httpClientOnce sync.Once
+	httpClientErr  error
+	tlsConfig      *tls.Config
+)
+
+// setupHTTPClient reads -tls_ca_file.
+func setupHTTPClient() error {
+	httpClientOnce.Do(func() {
+		// Defined in github.com/robustirc/robustirc/robusthttp, which is
+		// imported via github.com/robustirc/robustirc/util
+		tlsCAFile := flag.Lookup("tls_ca_file").Value.String()
+		if tlsCAFile != "" {
+			contents, err := ioutil.ReadFile(tlsCAFile)
+			if err != nil {
+				httpClientErr = err
+				return
+			}
+			roots := x509.NewCertPool()
+			if !roots.AppendCertsFromPEM(contents) {
+				httpClientErr = fmt.Errorf("Could not parse %q", tlsCAFile)
+				return
+			}
+			tlsConfig = &tls.Config{RootCAs: roots}
+		}
+	})
+	return httpClientErr
+}
+
+func transportOptions() robustclient.TransportOptions {
+	return robustclient.TransportOptions{
+		TLSConfig:             tlsConfig,
+		DialTimeout:           *httpDialTimeout,
+		ResponseHeaderTimeout: *httpResponseHeaderTimeout,
+		IdleConnTimeout:       *httpIdleConnTimeout,
+		MaxIdleConnsPerHost:   *httpMaxIdleConnsPerHost,
+		DisableKeepAlives:     !*httpKeepAlive,
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// clockOffset is the estimated offset (in nanoseconds) of the local
+// clock to the clock of -clock_reference, see estimateClockOffset.
+var clockOffset int64
+
+// referenceNow returns the current time according to -clock_reference,
+// or the local time if no reference is used. Timestamps which are
+// compared across processes must use referenceNow.
+func referenceNow() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&clockOffset)))
+}
+
+// serveTime returns the local time in nanoseconds since the UNIX epoch,
+// so that other processes can estimate their clock offset to this
+// process.
+func serveTime(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintf(w, "%d", time.Now().UnixNano())
+}
+
+// estimateClockOffset estimates the offset of the local clock to the
+// clock of the throughput process listening on addr, like NTP does:
+// the remote time is assumed to have been taken in the middle of the
+// request. Of all samples, the one with the lowest round trip time is
+// the most accurate.
+func estimateClockOffset(addr string, samples int) (offset, rtt time.Duration, err error) {
+	rtt = time.Duration(1<<63 - 1)
+	for i := 0; i < samples; i++ {
+		before := time.Now()
+		remote, err := fetchTime(addr)
+		if err != nil {
+			return 0, 0, err
+		}
+		after := time.Now()
+		sampleRTT := after.Sub(before)
+		if sampleRTT >= rtt {
+			continue
+		}
+		rtt = sampleRTT
+		midpoint := before.Add(sampleRTT / 2)
+		offset = remote.Sub(midpoint)
+	}
+	return offset, rtt, nil
+}
+
+func fetchTime(addr string) (time.Time, error) {
+	resp, err := http.Get(fmt.Sprintf("http://%s/time", addr))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return time.Time{}, fmt.Errorf("Unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return time.Time{}, err
+	}
+	nanos, err := strconv.ParseInt(string(b), 0, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+// synchronizeClock sets clockOffset relative to the throughput process
+// listening on addr.
+func synchronizeClock(addr string) error {
+	offset, rtt, err := estimateClockOffset(addr, 10)
+	if err != nil {
+		return fmt.Errorf("estimating clock offset to %q: %v", addr, err)
+	}
+	log.Printf("Clock offset to %q is %v (±%v)", addr, offset, rtt/2)
+	atomic.StoreInt64(&clockOffset, int64(offset))
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+// controller steers a standalone run via the HTTP control API, see
+// registerControlHandlers.
+type controller struct {
+	// runner returns the Runner of the current run, which changes
+	// between the variants of a -network_config_sweep.
+	runner func() *load.Runner
+}
+
+// do runs fn, which changes the run. The action fn returns is recorded
+// in the report.
+func (c *controller) do(fn func() (string, error)) error {
+	if *mode != "standalone" {
+		return fmt.Errorf("only supported with -mode=standalone")
+	}
+	action, err := fn()
+	if err != nil {
+		return err
+	}
+	log.Printf("Control: %s", action)
+	runReport.addControlAction(action)
+	return nil
+}
+
+type controlStatus struct {
+	RunID    string  `json:"run_id"`
+	Mode     string  `json:"mode"`
+	State    string  `json:"state"`
+	Elapsed  string  `json:"elapsed,omitempty"`
+	Rate     float64 `json:"rate,omitempty"`
+	Sessions int     `json:"sessions,omitempty"`
+	Dead     int     `json:"dead_sessions"`
+	Sent     uint64  `json:"sent"`
+	Received uint64  `json:"received"`
+
+	LastSecond  *load.Second     `json:"last_second,omitempty"`
+	Convergence load.Convergence `json:"convergence"`
+}
+
+func (c *controller) status() controlStatus {
+	status := c.runner().Status()
+	stats := c.runner().Stats()
+	s := controlStatus{
+		RunID:    identity.RunID,
+		Mode:     *mode,
+		State:    status.State,
+		Rate:     status.Rate,
+		Sessions: status.Sessions,
+		Dead:     status.DeadSessions,
+		Sent:     stats.Sent,
+		Received: stats.Received,
+	}
+	if !status.Started.IsZero() {
+		s.Elapsed = time.Since(status.Started).Round(time.Second).String()
+	}
+	s.LastSecond, s.Convergence = runReport.progress()
+	return s
+}
+
+func writeControlJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing control response: %v", err)
+	}
+}
+
+// writeControlError maps err to an HTTP status code.
+func writeControlError(w http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if err == load.ErrNotSending {
+		code = http.StatusConflict
+	}
+	http.Error(w, err.Error(), code)
+}
+
+// decodeControlRequest decodes the JSON body of a POST request into v.
+// It returns false if an error was written.
+func decodeControlRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return false
+	}
+	if v == nil {
+		return true
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (c *controller) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeControlJSON(w, c.status())
+}
+
+// handleRate changes the target rate, e.g. {"rate": 500}. Runner.SetRate
+// rejects invalid rates.
+func (c *controller) handleRate(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Rate float64 `json:"rate"`
+	}
+	if !decodeControlRequest(w, r, &req) {
+		return
+	}
+	err := c.do(func() (string, error) {
+		previous := c.runner().Status().Rate
+		if err := c.runner().SetRate(req.Rate); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("rate changed from %g to %g msg/s", previous, req.Rate), nil
+	})
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, c.status())
+}
+
+// handleSessions adds or removes sending sessions, e.g. {"add": 10} or
+// {"remove": 5}.
+func (c *controller) handleSessions(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Add    int `json:"add"`
+		Remove int `json:"remove"`
+	}
+	if !decodeControlRequest(w, r, &req) {
+		return
+	}
+	if req.Add < 0 || req.Remove < 0 || (req.Add == 0) == (req.Remove == 0) {
+		http.Error(w, `expected either a positive "add" or a positive "remove"`, http.StatusBadRequest)
+		return
+	}
+	err := c.do(func() (string, error) {
+		if req.Add > 0 {
+			if err := c.runner().AddSessions(req.Add); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("added %d sessions", req.Add), nil
+		}
+		removed, err := c.runner().RemoveSessions(req.Remove)
+		if err != nil {
+			return "", err
+		}
+		if removed == 0 {
+			return "", fmt.Errorf("no sessions can be removed: at least one sending session is kept")
+		}
+		return fmt.Sprintf("removed %d sessions", removed), nil
+	})
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, c.status())
+}
+
+// handleSnapshot snapshots the -snapshot_dashboards and adds them to the
+// report.
+func (c *controller) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !decodeControlRequest(w, r, nil) {
+		return
+	}
+	if *prometheusAddr == "" || *snapshotDashboards == "" {
+		http.Error(w, "snapshots require -prometheus and -snapshot_dashboards", http.StatusConflict)
+		return
+	}
+	var urls []string
+	for _, filename := range strings.Split(*snapshotDashboards, ",") {
+		snapshotUrl, err := snapshotMetrics(*prometheusAddr, filename)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		log.Printf("RobustIRC dashboard snapshot stored at %s", snapshotUrl)
+		runReport.addSnapshot(snapshotUrl)
+		urls = append(urls, snapshotUrl)
+	}
+	writeControlJSON(w, struct {
+		Snapshots []string `json:"snapshots"`
+	}{urls})
+}
+
+// handleStop stops sending. The run then drains in-flight messages and
+// finishes as if it had converged.
+func (c *controller) handleStop(w http.ResponseWriter, r *http.Request) {
+	if !decodeControlRequest(w, r, nil) {
+		return
+	}
+	err := c.do(func() (string, error) {
+		if err := c.runner().Stop(); err != nil {
+			return "", err
+		}
+		return "stop requested", nil
+	})
+	if err != nil {
+		writeControlError(w, err)
+		return
+	}
+	writeControlJSON(w, c.status())
+}
+
+// handleDisabled rejects requests to the endpoints which change the
+// run, unless -control_api is specified.
+func handleDisabled(w http.ResponseWriter, r *http.Request) {
+	http.Error(w, "changing the run requires -control_api", http.StatusForbidden)
+}
+
+// registerControlHandlers registers the control API on mux. The
+// endpoints which change the run are only served if mutable is true,
+// as they are not authenticated.
+func registerControlHandlers(mux *http.ServeMux, c *controller, mutable bool) {
+	mux.HandleFunc("/control/status", c.handleStatus)
+	for path, handler := range map[string]http.HandlerFunc{
+		"/control/rate":     c.handleRate,
+		"/control/sessions": c.handleSessions,
+		"/control/snapshot": c.handleSnapshot,
+		"/control/stop":     c.handleStop,
+	} {
+		if !mutable {
+			handler = handleDisabled
+		}
+		mux.HandleFunc(path, handler)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+func controlPost(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	return rec
+}
+
+func TestControlRate(t *testing.T) {
+	// A Runner without sessions, which measures counters that stay 0.
+	r, err := load.New(load.Options{
+		Sessions: 3,
+		Rate:     10,
+		Counters: func() (sent, received uint64, err error) {
+			return 0, 0, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{runner: func() *load.Runner { return r }}
+	if got, want := controlPost(c.handleStop, ``).Code, http.StatusConflict; got != want {
+		t.Errorf("before sending: got HTTP %d, want %d", got, want)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- r.Run(context.Background()) }()
+	for r.Status().State != load.StateSending {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, body := range []string{`{"rate": -1}`, `{"rate": 2e6}`} {
+		if got, want := controlPost(c.handleRate, body).Code, http.StatusBadRequest; got != want {
+			t.Errorf("%s: got HTTP %d, want %d", body, got, want)
+		}
+	}
+	if got, want := controlPost(c.handleRate, `{"rate": 20}`).Code, http.StatusOK; got != want {
+		t.Fatalf("got HTTP %d, want %d", got, want)
+	}
+	if got, want := c.status().Rate, 20.0; got != want {
+		t.Errorf("status: got rate %v, want %v", got, want)
+	}
+	if got, want := controlPost(c.handleSessions, `{"add": 1, "remove": 1}`).Code, http.StatusBadRequest; got != want {
+		t.Errorf("add and remove: got HTTP %d, want %d", got, want)
+	}
+
+	if got, want := controlPost(c.handleStop, ``).Code, http.StatusOK; got != want {
+		t.Fatalf("stop: got HTTP %d, want %d", got, want)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := controlPost(c.handleStop, ``).Code, http.StatusConflict; got != want {
+		t.Errorf("after sending: got HTTP %d, want %d", got, want)
+	}
+}
+
+func TestControlAPIOptIn(t *testing.T) {
+	r, err := load.New(load.Options{Sessions: 2, Rate: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &controller{runner: func() *load.Runner { return r }}
+	for _, tt := range []struct {
+		mutable bool
+		want    int
+	}{
+		{false, http.StatusForbidden},
+		// Reaches the handler, which rejects the negative rate.
+		{true, http.StatusBadRequest},
+	} {
+		mux := http.NewServeMux()
+		registerControlHandlers(mux, c, tt.mutable)
+
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("POST", "/control/rate", strings.NewReader(`{"rate": -1}`)))
+		if got := rec.Code; got != tt.want {
+			t.Errorf("POST /control/rate (mutable=%v): got HTTP %d, want %d", tt.mutable, got, tt.want)
+		}
+
+		// The status is always available.
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/control/status", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Errorf("GET /control/status (mutable=%v): got HTTP %d, want %d", tt.mutable, got, want)
+		}
+	}
+}
@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+	"golang.org/x/sync/errgroup"
+)
+
+// In coordinator mode, throughput does not run any sessions itself.
+// Instead, it distributes the sessions across agents (throughput
+// processes started with -mode=agent), which it steers via HTTP:
+//
+//   1. POST /agent/setup: the agent synchronizes its clock with the
+//      coordinator and sets up its range of sessions.
+//   2. POST /agent/start: the agent starts sending at the specified
+//      time (in the coordinator’s clock) with the specified rate.
+//   3. GET /agent/counters (every second): the coordinator sums up the
+//      cumulative counters and checks for convergence.
+//   4. POST /agent/stop, then GET /agent/result: the coordinator merges
+//      message accounting, latency histograms (overall and per node)
+//      and the sessions served per server of all agents.
+//   5. POST /agent/quit: the agent exits.
+
+// agentStartDelay is how far in the future the coordinator schedules
+// the synchronized start, so that all agents receive the start request
+// in time.
+const agentStartDelay = 2 * time.Second
+
+type agentSetup struct {
+	First    int `json:"first"`
+	Count    int `json:"count"`
+	Sessions int `json:"sessions"`
+	Channels int `json:"channels"`
+	// Coordinator is the -listen address of the coordinator, which serves
+	// as clock reference.
+	Coordinator string `json:"coordinator"`
+}
+
+type agentStart struct {
+	At   time.Time `json:"at"`
+	Rate float64   `json:"rate"`
+}
+
+type agentCounters struct {
+	Sent     uint64 `json:"sent"`
+	Received uint64 `json:"received"`
+	Err      string `json:"err,omitempty"`
+}
+
+type agentResult struct {
+	Accounting     map[int]load.AccountingSummary `json:"accounting"`
+	Latency        load.HistogramSnapshot         `json:"latency"`
+	NodeLatency    []load.NodeLatencySnapshot     `json:"node_latency"`
+	PostLatency    []load.PostLatencySnapshot     `json:"post_latency"`
+	SessionsServed map[string]sessionsServed      `json:"sessions_served"`
+}
+
+// agentExitDelay is how long an agent which received a signal keeps
+// serving its results to the coordinator, which most likely received
+// the signal as well and finishes the run.
+const agentExitDelay = 10 * time.Second
+
+// agent is the state of a throughput process running with -mode=agent.
+type agent struct {
+	mu      sync.Mutex
+	runner  *load.Runner
+	cancel  context.CancelFunc
+	stopped chan struct{}
+	err     error
+
+	shutdownOnce sync.Once
+}
+
+func (a *agent) setErr(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+func (a *agent) handleSetup(w http.ResponseWriter, r *http.Request) {
+	var req agentSetup
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Coordinator != "" {
+		if err := synchronizeClock(req.Coordinator); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	opts, err := runnerOptions(req.First, req.Count)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	opts.Sessions = req.Sessions
+	opts.Channels = req.Channels
+	// The coordinator measures, drains and reports.
+	opts.UntilConverged = false
+	opts.DrainTimeout = 0
+	opts.SecondRecorded = nil
+	opts.ConvergenceChecked = nil
+	runner, err := load.New(opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Setting up sessions %d to %d", req.First, req.First+req.Count-1)
+	if err := runner.Setup(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.runner = runner
+}
+
+func (a *agent) handleStart(w http.ResponseWriter, r *http.Request) {
+	var req agentStart
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.runner == nil {
+		http.Error(w, "sessions not set up yet", http.StatusConflict)
+		return
+	}
+	if a.stopped != nil {
+		http.Error(w, "already started", http.StatusConflict)
+		return
+	}
+	if req.Rate > 0 {
+		if err := a.runner.SetRate(req.Rate); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	a.cancel = cancel
+	a.stopped = make(chan struct{})
+	go func() {
+		defer close(a.stopped)
+		if err := a.run(ctx, req); err != nil && err != context.Canceled {
+			log.Printf("load failed: %v", err)
+			a.setErr(err)
+		}
+	}()
+}
+
+// run sends messages with the requested rate until stopped.
+func (a *agent) run(ctx context.Context, req agentStart) error {
+	if wait := req.At.Sub(referenceNow()); wait > 0 {
+		log.Printf("Starting to send at %v (in %v) with %v messages/s", req.At, wait, req.Rate)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return a.runner.Run(ctx)
+}
+
+func (a *agent) handleCounters(w http.ResponseWriter, r *http.Request) {
+	var counters agentCounters
+	a.mu.Lock()
+	if a.runner != nil {
+		stats := a.runner.Stats()
+		counters.Sent = stats.Sent
+		counters.Received = stats.Received
+	}
+	if a.err != nil {
+		counters.Err = a.err.Error()
+	}
+	a.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&counters)
+}
+
+func (a *agent) handleStop(w http.ResponseWriter, r *http.Request) {
+	a.stopSending()
+}
+
+// stopSending stops sending and returns once Run returned.
+func (a *agent) stopSending() {
+	a.mu.Lock()
+	runner, cancel, stopped := a.runner, a.cancel, a.stopped
+	a.cancel = nil
+	a.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	if err := runner.Stop(); err != nil {
+		// Run did not start (yet) or already returned.
+		cancel()
+	}
+	<-stopped
+	cancel()
+	log.Printf("Stopped sending")
+}
+
+func (a *agent) handleResult(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	runner := a.runner
+	a.mu.Unlock()
+	if runner == nil {
+		http.Error(w, "sessions not set up yet", http.StatusConflict)
+		return
+	}
+	nodeLatency, postLatency := runner.NodeLatencySnapshots()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&agentResult{
+		Accounting:     runner.Accounting(),
+		Latency:        runner.Latency().Snapshot(),
+		NodeLatency:    nodeLatency,
+		PostLatency:    postLatency,
+		SessionsServed: runReport.servedSessions(),
+	})
+}
+
+// shutdown stops sending and quits all sessions.
+func (a *agent) shutdown() {
+	a.shutdownOnce.Do(func() {
+		a.stopSending()
+		a.mu.Lock()
+		runner := a.runner
+		a.mu.Unlock()
+		if runner != nil {
+			quitSessions(runner)
+		}
+	})
+}
+
+func (a *agent) handleQuit(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Quitting as requested by the coordinator")
+	a.shutdown()
+	go func() {
+		// Give the HTTP response a chance to be written.
+		time.Sleep(100 * time.Millisecond)
+		os.Exit(0)
+	}()
+}
+
+// runAgent serves the agent API on -listen until the coordinator
+// requests quitting.
+func runAgent() error {
+	if *listen == "" {
+		return fmt.Errorf("-listen is required with -mode=agent")
+	}
+	a := &agent{}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %v, quitting sessions and exiting in %v", sig, agentExitDelay)
+		a.shutdown()
+		select {
+		case <-time.After(agentExitDelay):
+		case <-signals:
+		}
+		os.Exit(canceledExitCode)
+	}()
+	http.HandleFunc("/agent/setup", a.handleSetup)
+	http.HandleFunc("/agent/start", a.handleStart)
+	http.HandleFunc("/agent/counters", a.handleCounters)
+	http.HandleFunc("/agent/stop", a.handleStop)
+	http.HandleFunc("/agent/result", a.handleResult)
+	http.HandleFunc("/agent/quit", a.handleQuit)
+	log.Printf("Agent listening on %q", *listen)
+	return http.ListenAndServe(*listen, nil)
+}
+
+func agentRequest(method, addr, path string, req, resp interface{}) error {
+	var body bytes.Buffer
+	if req != nil {
+		if err := json.NewEncoder(&body).Encode(req); err != nil {
+			return err
+		}
+	}
+	u := fmt.Sprintf("http://%s%s", addr, path)
+	hreq, err := http.NewRequest(method, u, &body)
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hresp, err := http.DefaultClient.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	if got, want := hresp.StatusCode, http.StatusOK; got != want {
+		msg, _ := ioutil.ReadAll(hresp.Body)
+		return fmt.Errorf("%s %s: unexpected HTTP status code: got %d, want %d (%q)", method, u, got, want, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(hresp.Body).Decode(resp)
+}
+
+// forEachAgent calls fn for all agents in parallel.
+func forEachAgent(agents []string, fn func(idx int, addr string) error) error {
+	var g errgroup.Group
+	for idx, addr := range agents {
+		idx, addr := idx, addr // capture range variables
+		g.Go(func() error { return fn(idx, addr) })
+	}
+	return g.Wait()
+}
+
+func waitForAgents(agents []string) error {
+	log.Printf("Waiting for %d agents to become reachable", len(agents))
+	return forEachAgent(agents, func(_ int, addr string) error {
+		started := time.Now()
+		for {
+			err := agentRequest("GET", addr, "/agent/counters", nil, nil)
+			if err == nil {
+				return nil
+			}
+			if timeout := 1 * time.Minute; time.Since(started) > timeout {
+				return fmt.Errorf("agent %q did not become reachable within %v (error: %v)", addr, timeout, err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	})
+}
+
+// localAgentFlags are not passed on to local agents, because they only
+// apply to the coordinator.
+var localAgentFlags = map[string]bool{
+	"mode":                true,
+	"listen":              true,
+	"agents":              true,
+	"local_agents":        true,
+	"report":              true,
+	"linger":              true,
+	"clock_reference":     true,
+	"prometheus":          true,
+	"snapshot_dashboards": true,
+	"network_config_file": true,
+}
+
+// startLocalAgents starts n agents as child processes listening on
+// localhost and returns their addresses.
+func startLocalAgents(n int) ([]string, []*exec.Cmd, error) {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !localAgentFlags[f.Name] {
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value.String()))
+		}
+	})
+	var (
+		addrs []string
+		cmds  []*exec.Cmd
+	)
+	for i := 0; i < n; i++ {
+		// Find an unused port. There is a small window in which another
+		// process could grab the port, which is fine for testing.
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return addrs, cmds, err
+		}
+		addr := net.JoinHostPort("localhost", strconv.Itoa(ln.Addr().(*net.TCPAddr).Port))
+		ln.Close()
+
+		cmd := exec.Command(os.Args[0], append([]string{"-mode=agent", "-listen=" + addr}, args...)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return addrs, cmds, err
+		}
+		log.Printf("Started local agent %d (pid %d) on %q", i, cmd.Process.Pid, addr)
+		addrs = append(addrs, addr)
+		cmds = append(cmds, cmd)
+	}
+	return addrs, cmds, nil
+}
+
+// localAgentExitTimeout bounds how long local agents may take to quit
+// their sessions and exit, see stopLocalAgents.
+const localAgentExitTimeout = sessionQuitTimeout + 5*time.Second
+
+// stopLocalAgents makes the local agents started by startLocalAgents
+// quit and waits until they exited. Agents which cannot be asked to
+// quit (e.g. because they are not listening yet) or which do not exit
+// within localAgentExitTimeout are killed.
+func stopLocalAgents(addrs []string, cmds []*exec.Cmd) {
+	var wg sync.WaitGroup
+	for idx, cmd := range cmds {
+		wg.Add(1)
+		go func(addr string, cmd *exec.Cmd) {
+			defer wg.Done()
+			exited := make(chan struct{})
+			go func() {
+				cmd.Wait()
+				close(exited)
+			}()
+			// The agent might already have been asked to quit by
+			// runCoordinator, in which case it is (about to be) gone.
+			if err := agentRequest("POST", addr, "/agent/quit", nil, nil); err != nil {
+				select {
+				case <-exited:
+					return
+				case <-time.After(1 * time.Second):
+				}
+				log.Printf("Killing local agent (pid %d): %v", cmd.Process.Pid, err)
+				cmd.Process.Kill()
+			}
+			select {
+			case <-exited:
+			case <-time.After(localAgentExitTimeout):
+				log.Printf("Local agent (pid %d) did not exit within %v, killing it", cmd.Process.Pid, localAgentExitTimeout)
+				cmd.Process.Kill()
+				<-exited
+			}
+		}(addrs[idx], cmd)
+	}
+	wg.Wait()
+}
+
+// coordinatorAddr returns the address under which agents can reach
+// the coordinator’s -listen.
+func coordinatorAddr() string {
+	host, port, err := net.SplitHostPort(*listen)
+	if err != nil || host == "" {
+		return net.JoinHostPort("localhost", port)
+	}
+	return *listen
+}
+
+// splitSessions distributes sessions across n agents as evenly as
+// possible and returns the setup request for each agent.
+func splitSessions(sessions, n int) []agentSetup {
+	setups := make([]agentSetup, n)
+	first := 0
+	for idx := range setups {
+		count := sessions / n
+		if idx < sessions%n {
+			count++
+		}
+		setups[idx] = agentSetup{
+			First:       first,
+			Count:       count,
+			Sessions:    sessions,
+			Channels:    *numChannels,
+			Coordinator: coordinatorAddr(),
+		}
+		first += count
+	}
+	return setups
+}
+
+// sumAgentCounters returns the sum of the cumulative counters of all
+// agents.
+func sumAgentCounters(agents []string) (sent, received uint64, err error) {
+	counters := make([]agentCounters, len(agents))
+	err = forEachAgent(agents, func(idx int, addr string) error {
+		if err := agentRequest("GET", addr, "/agent/counters", nil, &counters[idx]); err != nil {
+			return err
+		}
+		if counters[idx].Err != "" {
+			return fmt.Errorf("agent %q: %s", addr, counters[idx].Err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, c := range counters {
+		sent += c.Sent
+		received += c.Received
+	}
+	return sent, received, nil
+}
+
+// newCoordinatorRunner returns a Runner which has no sessions itself,
+// but measures the sessions of agents.
+func newCoordinatorRunner(agents []string) (*load.Runner, error) {
+	opts, err := runnerOptions(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Churn happens on the agents, and finishCoordinator drains.
+	opts.ChurnRate = 0
+	opts.DrainTimeout = 0
+	opts.Counters = func() (sent, received uint64, err error) {
+		return sumAgentCounters(agents)
+	}
+	return load.New(opts)
+}
+
+func runCoordinator(ctx context.Context, agents []string) error {
+	if err := waitForAgents(agents); err != nil {
+		return err
+	}
+	defer quitAgents(agents)
+
+	setups := splitSessions(*numSessions, len(agents))
+	log.Printf("Joining %d channels with %d connections on %d agents\n", *numChannels, *numSessions, len(agents))
+	setupStarted := time.Now()
+	err := forEachAgent(agents, func(idx int, addr string) error {
+		return agentRequest("POST", addr, "/agent/setup", &setups[idx], nil)
+	})
+	if err != nil {
+		return err
+	}
+	setupDuration := time.Since(setupStarted)
+	runner.RecordSetupDuration(setupDuration)
+	log.Printf("All agents set up in %v", setupDuration)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	at := referenceNow().Add(agentStartDelay)
+	err = forEachAgent(agents, func(idx int, addr string) error {
+		sending := setups[idx].Count
+		if setups[idx].First == 0 {
+			sending--
+		}
+		return agentRequest("POST", addr, "/agent/start", &agentStart{
+			At:   at,
+			Rate: *rate * float64(sending) / float64(*numSessions-1),
+		}, nil)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-time.After(at.Sub(referenceNow())):
+	case <-ctx.Done():
+	}
+
+	runErr := runner.Run(ctx)
+	if runErr != nil && ctx.Err() == nil {
+		return runErr
+	}
+	if err := finishCoordinator(ctx, agents); err != nil {
+		return err
+	}
+	return runErr
+}
+
+// finishCoordinator stops all agents and merges their results. If ctx
+// is done, it does not wait for in-flight messages.
+func finishCoordinator(ctx context.Context, agents []string) error {
+	err := forEachAgent(agents, func(_ int, addr string) error {
+		return agentRequest("POST", addr, "/agent/stop", nil, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if ctx.Err() == nil {
+		log.Printf("Waiting %v for in-flight messages", *drainTimeout)
+		time.Sleep(*drainTimeout)
+	}
+
+	results := make([]agentResult, len(agents))
+	err = forEachAgent(agents, func(idx int, addr string) error {
+		return agentRequest("GET", addr, "/agent/result", nil, &results[idx])
+	})
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		runner.Merge(result.Accounting, result.Latency)
+		runner.MergeNodeLatencies(result.NodeLatency, result.PostLatency)
+		runReport.mergeSessionsServed(result.SessionsServed)
+	}
+	logResults()
+	return nil
+}
+
+// quitAgents makes all agents quit their sessions and exit.
+func quitAgents(agents []string) {
+	err := forEachAgent(agents, func(_ int, addr string) error {
+		return agentRequest("POST", addr, "/agent/quit", nil, nil)
+	})
+	if err != nil {
+		log.Printf("Quitting agents: %v", err)
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robustirc/benchmark/internal/kube"
+	"github.com/robustirc/robustirc/util"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+var faultsInjectedMetric = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "faults_injected_total",
+		Help: "Number of faults injected by -faults, by action",
+	},
+	[]string{"action"})
+
+func init() {
+	prometheus.MustRegister(faultsInjectedMetric)
+}
+
+// faultNode is a node of the network, identified by its index in
+// -network.
+type faultNode struct {
+	Index int
+	Addr  string
+}
+
+// Node returns the 1-based node number, as used in -faults and in the
+// Kubernetes deployment (robustirc-node-1, …).
+func (n faultNode) Node() int {
+	return n.Index + 1
+}
+
+// actuator injects faults. action is one of kill, start, pause or
+// resume.
+type actuator interface {
+	act(action string, node faultNode) error
+}
+
+// commandActuator runs local commands (-fault_kill_command etc.), e.g.
+// to signal RobustIRC processes which run on the local machine.
+type commandActuator struct {
+	commands map[string]*template.Template
+}
+
+func newCommandActuator(commands map[string]string) (*commandActuator, error) {
+	a := &commandActuator{commands: make(map[string]*template.Template)}
+	for action, command := range commands {
+		if command == "" {
+			continue
+		}
+		tmpl, err := template.New(action).Parse(command)
+		if err != nil {
+			return nil, fmt.Errorf("-fault_%s_command: %v", action, err)
+		}
+		a.commands[action] = tmpl
+	}
+	return a, nil
+}
+
+func (a *commandActuator) act(action string, node faultNode) error {
+	tmpl, ok := a.commands[action]
+	if !ok {
+		return fmt.Errorf("-fault_%s_command not specified", action)
+	}
+	var command bytes.Buffer
+	if err := tmpl.Execute(&command, node); err != nil {
+		return err
+	}
+	log.Printf("fault: running %q", command.String())
+	out, err := exec.Command("/bin/sh", "-c", command.String()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%q: %v (output: %s)", command.String(), err, out)
+	}
+	return nil
+}
+
+// kubernetesActuator deletes the pods of RobustIRC nodes, which are
+// then recreated by their replication controller (see
+// deployments/kubernetes.jinja). Hence, kill implies a restart, and
+// start, pause and resume are not supported. Listing and deleting pods
+// requires the permissions of deployments/throughput.rbac.yaml.
+type kubernetesActuator struct {
+	client    *kubernetes.Clientset
+	namespace string
+	selector  *template.Template
+}
+
+// newKubernetesActuator returns an actuator for the pods in namespace,
+// which defaults to the namespace throughput runs in.
+func newKubernetesActuator(namespace, selector string) (*kubernetesActuator, error) {
+	tmpl, err := template.New("selector").Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("-fault_kubernetes_selector: %v", err)
+	}
+	client, err := kube.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if namespace == "" {
+		namespace = kube.Namespace()
+	}
+	return &kubernetesActuator{client: client, namespace: namespace, selector: tmpl}, nil
+}
+
+func (a *kubernetesActuator) act(action string, node faultNode) error {
+	if action != "kill" {
+		return fmt.Errorf("action %q is not supported with -fault_actuator=kubernetes, pods are recreated automatically after kill", action)
+	}
+	var selector bytes.Buffer
+	if err := a.selector.Execute(&selector, node); err != nil {
+		return err
+	}
+	pods := a.client.CoreV1().Pods(a.namespace)
+	list, err := pods.List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return err
+	}
+	if len(list.Items) == 0 {
+		return fmt.Errorf("no pods match %q", selector.String())
+	}
+	for _, pod := range list.Items {
+		log.Printf("fault: deleting pod %s/%s", a.namespace, pod.Name)
+		if err := pods.Delete(pod.Name, &metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// faultEntry is an entry of the fault schedule.
+type faultEntry struct {
+	at     time.Duration
+	action string
+	target string
+}
+
+var faultActions = map[string]bool{
+	"kill":    true,
+	"start":   true,
+	"restart": true,
+	"pause":   true,
+	"resume":  true,
+}
+
+// parseFaultSchedule parses a fault schedule, which consists of entries
+// separated by semicolons or newlines. Each entry is
+//
+//	<offset> <action> <target>
+//
+// where offset is a duration since sending started, action is one of
+// kill, start, restart (kill, then start), pause or resume, and target
+// is “leader”, “follower” (a random follower), a node number (1-based,
+// in the order of -network) or a host:port address of -network. A “t=”
+// prefix on the offset and an “at” prefix on the entry are optional,
+// i.e. “at t=5m kill leader” is valid.
+func parseFaultSchedule(spec string) ([]faultEntry, error) {
+	var entries []faultEntry
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "at" {
+			fields = fields[1:]
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid fault %q: expected <offset> <action> <target>", strings.TrimSpace(line))
+		}
+		at, err := time.ParseDuration(strings.TrimPrefix(fields[0], "t="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %v", strings.TrimSpace(line), err)
+		}
+		if !faultActions[fields[1]] {
+			return nil, fmt.Errorf("invalid fault %q: unknown action %q, expected kill, start, restart, pause or resume", strings.TrimSpace(line), fields[1])
+		}
+		entries = append(entries, faultEntry{at: at, action: fields[1], target: fields[2]})
+	}
+	for idx := 1; idx < len(entries); idx++ {
+		if entries[idx].at < entries[idx-1].at {
+			return nil, fmt.Errorf("faults must be ordered by offset, but %v is before %v", entries[idx].at, entries[idx-1].at)
+		}
+	}
+	return entries, nil
+}
+
+type faultReport struct {
+	At     string    `json:"at"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Node   string    `json:"node,omitempty"`
+	Error  string    `json:"error,omitempty"`
+
+	// BaselineRate is the mean number of messages received per second
+	// within the 10s before the fault. Zero means the baseline is
+	// unknown (e.g. nothing was received yet), in which case recovery
+	// is not measured.
+	BaselineRate float64 `json:"baseline_rate"`
+	// Dropped is whether the received messages/s fell below 90% of
+	// BaselineRate after the fault.
+	Dropped   bool `json:"dropped"`
+	Recovered bool `json:"recovered"`
+	// RecoveryTime is how long it took until the received messages/s
+	// were back to at least 90% of BaselineRate after dropping.
+	RecoveryTime string `json:"recovery_time,omitempty"`
+	// Lost is the number of messages which were sent between the fault
+	// and the recovery (±1s) and never received.
+	Lost uint64 `json:"lost"`
+
+	recoveredAt time.Time
+	// healthy is the number of seconds after the fault for which the
+	// received messages/s stayed at or above 90% of BaselineRate
+	// without dropping first.
+	healthy int
+}
+
+// faultHealthySeconds is how long the received messages/s need to stay
+// at or above 90% of the baseline after a fault until the network is
+// considered unaffected, i.e. until the run stops waiting for a drop.
+const faultHealthySeconds = 10
+
+// unaffected returns whether the network stayed healthy after r.
+func (r *faultReport) unaffected() bool {
+	return !r.Dropped && r.healthy >= faultHealthySeconds
+}
+
+// faultInjector executes a fault schedule and measures how the network
+// recovers from each fault.
+type faultInjector struct {
+	schedule []faultEntry
+	servers  []string
+	actuator actuator
+
+	mu       sync.Mutex
+	executed int
+	faults   []*faultReport
+	// history contains the messages received per second, most recent
+	// last.
+	history []uint64
+}
+
+func newFaultInjector(schedule []faultEntry, servers []string, a actuator) *faultInjector {
+	return &faultInjector{
+		schedule: schedule,
+		servers:  servers,
+		actuator: a,
+	}
+}
+
+// resolve returns the node which target refers to.
+func (f *faultInjector) resolve(target string) (faultNode, error) {
+	if n, err := strconv.Atoi(target); err == nil {
+		if n < 1 || n > len(f.servers) {
+			return faultNode{}, fmt.Errorf("node %d out of range [1, %d]", n, len(f.servers))
+		}
+		return faultNode{Index: n - 1, Addr: f.servers[n-1]}, nil
+	}
+	for idx, server := range f.servers {
+		if server == target {
+			return faultNode{Index: idx, Addr: server}, nil
+		}
+	}
+	if target != "leader" && target != "follower" {
+		return faultNode{}, fmt.Errorf("unknown target %q, expected leader, follower, a node number or an address of -network", target)
+	}
+	var leader string
+	for _, server := range f.servers {
+		status, err := util.GetServerStatus(server, networkPassword())
+		if err == nil && status.Leader != "" {
+			leader = status.Leader
+			break
+		}
+	}
+	if leader == "" {
+		return faultNode{}, fmt.Errorf("no leader found")
+	}
+	var candidates []faultNode
+	for idx, server := range f.servers {
+		if (target == "leader") == (server == leader) {
+			candidates = append(candidates, faultNode{Index: idx, Addr: server})
+		}
+	}
+	if len(candidates) == 0 {
+		return faultNode{}, fmt.Errorf("no %s found in -network (leader is %q)", target, leader)
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+func (f *faultInjector) inject(entry faultEntry) *faultReport {
+	r := &faultReport{
+		At:     entry.at.String(),
+		Time:   time.Now(),
+		Action: entry.action,
+		Target: entry.target,
+	}
+	node, err := f.resolve(entry.target)
+	if err == nil {
+		r.Node = node.Addr
+		log.Printf("fault: %s %s (node %d, %s)", entry.action, entry.target, node.Node(), node.Addr)
+		faultsInjectedMetric.WithLabelValues(entry.action).Inc()
+		if entry.action == "restart" {
+			if err = f.actuator.act("kill", node); err == nil {
+				err = f.actuator.act("start", node)
+			}
+		} else {
+			err = f.actuator.act(entry.action, node)
+		}
+	}
+	if err != nil {
+		log.Printf("fault: %s %s failed: %v", entry.action, entry.target, err)
+		r.Error = err.Error()
+	}
+	return r
+}
+
+// start executes the schedule relative to started in the background
+// until ctx is done.
+func (f *faultInjector) start(ctx context.Context, started time.Time) {
+	go func() {
+		for _, entry := range f.schedule {
+			timer := time.NewTimer(time.Until(started.Add(entry.at)))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			f.mu.Lock()
+			baseline := f.baselineLocked()
+			f.mu.Unlock()
+			r := f.inject(entry)
+			r.BaselineRate = baseline
+			f.mu.Lock()
+			f.faults = append(f.faults, r)
+			f.executed++
+			f.mu.Unlock()
+		}
+	}()
+}
+
+func (f *faultInjector) baselineLocked() float64 {
+	samples := f.history
+	if len(samples) > 10 {
+		samples = samples[len(samples)-10:]
+	}
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum uint64
+	for _, s := range samples {
+		sum += s
+	}
+	return float64(sum) / float64(len(samples))
+}
+
+// measured returns whether the recovery from r is measured, which
+// requires that injecting the fault succeeded and that the baseline is
+// known.
+func (r *faultReport) measured() bool {
+	return r.Error == "" && r.BaselineRate > 0
+}
+
+// observe must be called once per second with the number of messages
+// received within the last second.
+func (f *faultInjector) observe(received uint64) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.history = append(f.history, received)
+	now := time.Now()
+	for _, r := range f.faults {
+		if !r.measured() || r.Recovered || r.unaffected() || now.Sub(r.Time) > *faultRecoveryTimeout {
+			continue
+		}
+		threshold := 0.9 * r.BaselineRate
+		if !r.Dropped {
+			// Only a drop below the threshold makes for a recovery,
+			// otherwise the first second after the fault would count.
+			r.Dropped = float64(received) < threshold
+			if !r.Dropped {
+				r.healthy++
+			}
+			continue
+		}
+		if float64(received) >= threshold {
+			r.Recovered = true
+			r.recoveredAt = now
+			r.RecoveryTime = now.Sub(r.Time).String()
+			log.Printf("fault: recovered from %s %s after %s", r.Action, r.Target, r.RecoveryTime)
+		}
+	}
+}
+
+// done returns whether all faults were injected and the network either
+// recovered from them, stayed healthy after them (see
+// faultHealthySeconds) or -fault_recovery_timeout passed.
+func (f *faultInjector) done() bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.executed < len(f.schedule) {
+		return false
+	}
+	for _, r := range f.faults {
+		if r.measured() && !r.Recovered && !r.unaffected() && time.Since(r.Time) <= *faultRecoveryTimeout {
+			return false
+		}
+	}
+	return true
+}
+
+// logReport determines the messages lost around each fault and logs
+// the results. In-flight messages must have been drained.
+func (f *faultInjector) logReport() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reports := make([]faultReport, 0, len(f.faults))
+	for _, r := range f.faults {
+		end := r.recoveredAt
+		switch {
+		case r.unaffected():
+			end = r.Time.Add(faultHealthySeconds * time.Second)
+		case !r.Recovered:
+			end = r.Time.Add(*faultRecoveryTimeout)
+		}
+		// Messages which were in flight when the fault was injected
+		// or when the network recovered are attributed to the fault.
+		r.Lost = runner.InFlight(r.Time.Add(-1*time.Second), end.Add(1*time.Second))
+		recovery := "not recovered"
+		switch {
+		case r.Error != "":
+			recovery = "failed: " + r.Error
+		case r.BaselineRate == 0:
+			recovery = "baseline unknown"
+		case r.Recovered:
+			recovery = "recovered after " + r.RecoveryTime
+		case !r.Dropped:
+			recovery = "no drop observed"
+		}
+		log.Printf("fault at %s: %s %s (%s): %s, baseline %.0f msgs/s, %d messages lost",
+			r.At, r.Action, r.Target, r.Node, recovery, r.BaselineRate, r.Lost)
+		reports = append(reports, *r)
+	}
+	runReport.setFaults(reports)
+}
+
+// newActuator returns the actuator selected by -fault_actuator.
+func newActuator() (actuator, error) {
+	switch *faultActuator {
+	case "local":
+		return newCommandActuator(map[string]string{
+			"kill":   *faultKillCommand,
+			"start":  *faultStartCommand,
+			"pause":  *faultPauseCommand,
+			"resume": *faultResumeCommand,
+		})
+	case "kubernetes":
+		return newKubernetesActuator(*faultKubernetesNamespace, *faultKubernetesSelector)
+	}
+	return nil, fmt.Errorf("unknown -fault_actuator=%q, expected local or kubernetes", *faultActuator)
+}
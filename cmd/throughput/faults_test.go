@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+)
+
+func TestParseFaultSchedule(t *testing.T) {
+	got, err := parseFaultSchedule("at t=5m kill leader; 10m restart 2\n15m pause localhost:13001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []faultEntry{
+		{at: 5 * time.Minute, action: "kill", target: "leader"},
+		{at: 10 * time.Minute, action: "restart", target: "2"},
+		{at: 15 * time.Minute, action: "pause", target: "localhost:13001"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseFaultSchedule: got %+v, want %+v", got, want)
+	}
+
+	for _, spec := range []string{
+		"5m kill",
+		"5m explode leader",
+		"soon kill leader",
+		"10m kill leader; 5m start 1",
+	} {
+		if _, err := parseFaultSchedule(spec); err == nil {
+			t.Errorf("parseFaultSchedule(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
+
+func TestFaultRecovery(t *testing.T) {
+	f := newFaultInjector(nil, nil, nil)
+	r := &faultReport{Time: time.Now(), BaselineRate: 100}
+	unknown := &faultReport{Time: time.Now()}
+	f.faults = []*faultReport{r, unknown}
+
+	// Receiving at the baseline rate right after the fault is not a
+	// recovery, the network did not drop below the threshold yet.
+	f.observe(100)
+	if r.Dropped || r.Recovered {
+		t.Fatalf("without a drop: got %+v, want neither dropped nor recovered", r)
+	}
+	if f.done() {
+		t.Fatalf("done() before recovering")
+	}
+	f.observe(10)
+	if !r.Dropped || r.Recovered {
+		t.Fatalf("after a drop: got %+v, want dropped, not recovered", r)
+	}
+	f.observe(95)
+	if !r.Recovered {
+		t.Fatalf("after recovering: got %+v, want recovered", r)
+	}
+	if unknown.Dropped || unknown.Recovered {
+		t.Errorf("with an unknown baseline: got %+v, want neither dropped nor recovered", unknown)
+	}
+	if !f.done() {
+		t.Errorf("done() after recovering: got false, want true")
+	}
+}
+
+func TestFaultWithoutDrop(t *testing.T) {
+	f := newFaultInjector(nil, nil, nil)
+	r := &faultReport{Time: time.Now(), BaselineRate: 100}
+	f.faults = []*faultReport{r}
+
+	for i := 0; i < faultHealthySeconds-1; i++ {
+		f.observe(95)
+	}
+	if f.done() {
+		t.Fatalf("done() after %d healthy seconds", faultHealthySeconds-1)
+	}
+	f.observe(95)
+	if !f.done() {
+		t.Fatalf("done() after %d healthy seconds: got false, want true", faultHealthySeconds)
+	}
+	// A later drop is not attributed to the fault.
+	f.observe(10)
+	if r.Dropped || r.Recovered {
+		t.Errorf("after the network stayed healthy: got %+v, want neither dropped nor recovered", r)
+	}
+}
+
+// fakeActuator stops and starts nodes of a fake RobustIRC network.
+type fakeActuator struct {
+	n *fakerobustirc.Network
+}
+
+func (a *fakeActuator) act(action string, node faultNode) error {
+	switch action {
+	case "kill":
+		a.n.StopNode(node.Index)
+	case "start":
+		a.n.StartNode(node.Index)
+	default:
+		return fmt.Errorf("action %q not supported", action)
+	}
+	return nil
+}
+
+func TestFaultSchedule(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in -short mode")
+	}
+
+	n := fakerobustirc.NewNetwork(3, fakerobustirc.Options{
+		LossRate:        0.01,
+		ElectionTimeout: 2 * time.Second,
+	})
+	defer n.Close()
+
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	caFile, err := n.WriteCAFile(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"network":                n.Addr(),
+		"tls_ca_file":            caFile,
+		"sessions":               "5",
+		"channels":               "1",
+		"rate":                   "200",
+		"min_duration":           "0",
+		"drain_timeout":          "1s",
+		"setup_timeout":          "30s",
+		"health_check":           "status",
+		"fault_recovery_timeout": "1m",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("flag.Set(%q, %q): %v", name, value, err)
+		}
+	}
+	if err := waitForHealthy(n.Servers()); err != nil {
+		t.Fatal(err)
+	}
+	leader := n.Leader()
+
+	// The leader is down for 4s, i.e. the network is without leader
+	// for the 2s election timeout, and the sessions of the leader
+	// cannot make progress until it is started again.
+	schedule, err := parseFaultSchedule("3s kill leader; 7s start 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	faultSchedule = newFaultInjector(schedule, n.Servers(), &fakeActuator{n: n})
+	r, err := newStandaloneRunner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRunner(r)
+	defer func() {
+		// Do not leave state behind for the tests which follow.
+		faultSchedule = nil
+		setRunner(nil)
+	}()
+	started := time.Now()
+	if err := runThroughputTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The run does not wait for -fault_recovery_timeout when the
+	// network stays healthy after a fault.
+	if elapsed := time.Since(started); elapsed >= *faultRecoveryTimeout {
+		t.Errorf("run took %v, want less than -fault_recovery_timeout (%v)", elapsed, *faultRecoveryTimeout)
+	}
+
+	faults := faultSchedule.faults
+	if got, want := len(faults), len(schedule); got != want {
+		t.Fatalf("faults: got %d, want %d", got, want)
+	}
+	for _, f := range faults {
+		if f.Error != "" {
+			t.Errorf("fault %s %s failed: %v", f.Action, f.Target, f.Error)
+		}
+	}
+	if got, want := faults[0].Node, leader; got != want {
+		t.Errorf("kill leader: got node %q, want %q", got, want)
+	}
+	if kill := faults[0]; !kill.Dropped || !kill.Recovered {
+		t.Errorf("kill leader: got %+v, want dropped and recovered", kill)
+	}
+	if start := faults[1]; !start.Recovered && !start.unaffected() {
+		t.Errorf("start 1: got %+v, want recovered or unaffected", start)
+	}
+
+	// Lost messages around the faults must have been lost by the
+	// network: faults only delay messages.
+	total := r.AccountingTotal()
+	_, _, dropped := n.Stats()
+	if got, want := total.Lost, dropped; got != want {
+		t.Errorf("lost messages: got %d, want %d (dropped by the network)", got, want)
+	}
+	for _, f := range faults {
+		if f.Lost > total.Lost {
+			t.Errorf("fault %s %s: got %d lost messages, want at most %d (lost in total)", f.Action, f.Target, f.Lost, total.Lost)
+		}
+	}
+	if faults[0].Lost == 0 && dropped > 0 {
+		t.Errorf("kill leader: got 0 lost messages, want > 0 (network dropped %d)", dropped)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/robustclient"
+	"github.com/robustirc/robustirc/util"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// roundTripTimeout bounds a single -health_check=roundtrip attempt.
+const roundTripTimeout = 10 * time.Second
+
+// networkPassword returns the password for the privileged endpoints of
+// the RobustIRC network, e.g. /status.
+func networkPassword() string {
+	return os.Getenv("ROBUSTIRC_NETWORK_PASSWORD")
+}
+
+// waitForHealthy waits until the network passes -health_check.
+func waitForHealthy(servers []string) error {
+	if *healthCheck == "none" {
+		log.Printf("Not checking RobustIRC network health (-health_check=none)")
+		return nil
+	}
+	log.Printf("Waiting for RobustIRC network to become healthy")
+	started := time.Now()
+	for {
+		err := checkHealth(servers)
+		if err == nil {
+			return nil
+		}
+		log.Printf("network health: %v", err)
+		if time.Since(started) > *healthTimeout {
+			return fmt.Errorf("RobustIRC network did not become healthy within %v (error: %v)", *healthTimeout, err)
+		}
+		// Intentionally without exponential backoff. The RobustIRC
+		// instance in question is only hit by this single throughput
+		// process, so it can take a retry every -health_interval.
+		time.Sleep(*healthInterval)
+	}
+}
+
+// checkHealth checks the network once according to -health_check.
+func checkHealth(servers []string) error {
+	statuses, err := util.EnsureNetworkHealthy(servers, networkPassword())
+	if err != nil {
+		return fmt.Errorf("%v, statuses = %+v", err, statuses)
+	}
+	var leader string
+	for _, status := range statuses {
+		leader = status.Leader
+	}
+	if *healthCheck != "roundtrip" {
+		log.Printf("RobustIRC network is healthy, leader is %s", leader)
+		return nil
+	}
+	rtt, err := checkRoundTrip(servers)
+	if err != nil {
+		return fmt.Errorf("round trip: %v", err)
+	}
+	log.Printf("RobustIRC network is healthy, leader is %s, a test message round-tripped in %v", leader, rtt)
+	return nil
+}
+
+// checkRoundTrip verifies that the network delivers messages: a session
+// created on the first server posts a message to a channel, which a
+// session created on the last server needs to receive. It returns how
+// long delivering the message took.
+func checkRoundTrip(servers []string) (time.Duration, error) {
+	if err := setupHTTPClient(); err != nil {
+		return 0, err
+	}
+	deadline := time.Now().Add(roundTripTimeout)
+	id := fmt.Sprintf("ready%d", rand.Intn(1000000))
+	channel := "#" + id
+
+	receiver, err := newReadinessSession(servers, servers[len(servers)-1], id+"r", channel, deadline)
+	if err != nil {
+		return 0, err
+	}
+	defer receiver.Delete("readiness check")
+	sender, err := newReadinessSession(servers, servers[0], id+"s", channel, deadline)
+	if err != nil {
+		return 0, err
+	}
+	defer sender.Delete("readiness check")
+
+	posted := time.Now()
+	if err := sender.PostMessage(fmt.Sprintf("PRIVMSG %s :%s\r\n", channel, id)); err != nil {
+		return 0, err
+	}
+	err = awaitMessage(receiver, deadline, func(msg *irc.Message) bool {
+		return msg.Command == irc.PRIVMSG && msg.Trailing() == id
+	})
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(posted), nil
+}
+
+// newReadinessSession creates a session on target which registers as
+// nick and joins channel.
+func newReadinessSession(servers []string, target, nick, channel string, deadline time.Time) (*robustclient.Session, error) {
+	session, err := robustclient.Create(robustclient.Options{
+		Servers:   servers,
+		Target:    target,
+		Transport: transportOptions(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		for _, msg := range []string{
+			fmt.Sprintf("NICK %s\r\n", nick),
+			fmt.Sprintf("USER %s 0 * :%s\r\n", nick, nick),
+		} {
+			if err := session.PostMessage(msg); err != nil {
+				return err
+			}
+		}
+		err := awaitMessage(session, deadline, func(msg *irc.Message) bool {
+			return msg.Command == irc.RPL_WELCOME
+		})
+		if err != nil {
+			return err
+		}
+		if err := session.PostMessage(fmt.Sprintf("JOIN %s\r\n", channel)); err != nil {
+			return err
+		}
+		return awaitMessage(session, deadline, func(msg *irc.Message) bool {
+			return msg.Command == irc.RPL_ENDOFNAMES
+		})
+	}()
+	if err != nil {
+		session.Delete("readiness check")
+		return nil, fmt.Errorf("session on %s: %v", target, err)
+	}
+	return session, nil
+}
+
+// awaitMessage returns once session received a message for which match
+// returns true.
+func awaitMessage(session *robustclient.Session, deadline time.Time, match func(*irc.Message) bool) error {
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	for {
+		select {
+		case msg := <-session.Messages:
+			if ircmsg := irc.ParseMessage(msg); ircmsg != nil && match(ircmsg) {
+				return nil
+			}
+
+		case err := <-session.Errors:
+			return err
+
+		case <-timeout.C:
+			return fmt.Errorf("no reply within %v", roundTripTimeout)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// runIdentity tells runs apart in the report and in metrics.
+type runIdentity struct {
+	RunID             string            `json:"run_id"`
+	BenchmarkRevision string            `json:"benchmark_revision,omitempty"`
+	RobustIRCRevision string            `json:"robustirc_revision,omitempty"`
+	ConfigHash        string            `json:"config_hash"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+// identity is set up by main, see setupIdentity.
+var identity runIdentity
+
+// unhashedFlags do not influence the measurements, so they are excluded
+// from the config hash: runs with the same config hash are comparable.
+var unhashedFlags = map[string]bool{
+	"run_id":                true,
+	"labels":                true,
+	"benchmark_revision":    true,
+	"robustirc_revision":    true,
+	"report":                true,
+	"listen":                true,
+	"linger":                true,
+	"pushgateway":           true,
+	"remote_write":          true,
+	"push_interval":         true,
+	"baseline":              true,
+	"baseline_tolerance":    true,
+	"baseline_significance": true,
+	"slo":                   true,
+	"slo_file":              true,
+	"snapshot_dashboards":   true,
+}
+
+// configHash returns a short hash of the flags in config (except
+// unhashedFlags) and the network config.
+func configHash(config map[string]string, networkConfig string) string {
+	names := make([]string, 0, len(config))
+	for name := range config {
+		if !unhashedFlags[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s=%s\n", name, config[name])
+	}
+	fmt.Fprintf(h, "\n%s", networkConfig)
+	return fmt.Sprintf("%x", h.Sum(nil))[:12]
+}
+
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// parseLabels parses -labels, e.g. “team=irc,purpose=nightly”.
+func parseLabels(spec string) (map[string]string, error) {
+	labels := make(map[string]string)
+	for _, kv := range strings.Split(spec, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid label %q: expected <name>=<value>", kv)
+		}
+		name := strings.TrimSpace(parts[0])
+		if !labelNameRe.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		switch name {
+		case "run_id", "config_hash", "benchmark_revision", "robustirc_revision", "job", "instance":
+			return nil, fmt.Errorf("label %q is reserved", name)
+		}
+		labels[name] = strings.TrimSpace(parts[1])
+	}
+	return labels, nil
+}
+
+// setupIdentity sets up identity. It must be called after runReport.start.
+func setupIdentity(labels map[string]string) {
+	identity = runIdentity{
+		RunID:             *runIDFlag,
+		BenchmarkRevision: *benchmarkRevision,
+		RobustIRCRevision: *robustircRevision,
+		ConfigHash:        runReport.configHash(),
+		Labels:            labels,
+	}
+	if identity.RunID == "" {
+		identity.RunID = time.Now().UTC().Format("20060102-150405")
+	}
+	runReport.setIdentity(identity)
+}
+
+// constLabels returns the labels which are attached to all metrics.
+func (id runIdentity) constLabels() prometheus.Labels {
+	labels := prometheus.Labels{
+		"run_id":      id.RunID,
+		"config_hash": id.ConfigHash,
+	}
+	if id.BenchmarkRevision != "" {
+		labels["benchmark_revision"] = id.BenchmarkRevision
+	}
+	if id.RobustIRCRevision != "" {
+		labels["robustirc_revision"] = id.RobustIRCRevision
+	}
+	for name, value := range id.Labels {
+		labels[name] = value
+	}
+	return labels
+}
+
+// labelledGatherer adds constant labels to all metrics of a Gatherer.
+// Labels which a metric already has are left alone.
+type labelledGatherer struct {
+	prometheus.Gatherer
+	labels prometheus.Labels
+}
+
+func (g labelledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.Gatherer.Gather()
+	for _, mf := range families {
+		for _, m := range mf.Metric {
+			existing := make(map[string]bool, len(m.Label))
+			for _, lp := range m.Label {
+				existing[lp.GetName()] = true
+			}
+			for name, value := range g.labels {
+				if existing[name] {
+					continue
+				}
+				name, value := name, value
+				m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+			}
+			sort.Slice(m.Label, func(i, j int) bool {
+				return m.Label[i].GetName() < m.Label[j].GetName()
+			})
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseLabels(t *testing.T) {
+	got, err := parseLabels("team=irc, purpose=nightly,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["team"] != "irc" || got["purpose"] != "nightly" {
+		t.Errorf("parseLabels: got %v, want map[purpose:nightly team:irc]", got)
+	}
+	for _, spec := range []string{"team", "1team=irc", "run_id=x", "__name__=x"} {
+		if _, err := parseLabels(spec); err == nil {
+			t.Errorf("parseLabels(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	config := map[string]string{"sessions": "50", "run_id": "a", "report": "/tmp/a"}
+	hash := configHash(config, "[network]")
+	if got := configHash(map[string]string{"sessions": "50", "run_id": "b"}, "[network]"); got != hash {
+		t.Errorf("configHash depends on unhashed flags: got %s, want %s", got, hash)
+	}
+	if got := configHash(map[string]string{"sessions": "51"}, "[network]"); got == hash {
+		t.Errorf("configHash does not depend on -sessions")
+	}
+	if got := configHash(config, "[other]"); got == hash {
+		t.Errorf("configHash does not depend on the network config")
+	}
+}
+
+func TestLabelledGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	errors := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "errors", Help: "h"}, []string{"server"})
+	errors.WithLabelValues("a").Inc()
+	reg.MustRegister(errors)
+
+	families, err := labelledGatherer{reg, prometheus.Labels{"run_id": "r1", "server": "ignored"}}.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := families[0].GetMetric()[0].GetLabel()
+	if len(labels) != 2 {
+		t.Fatalf("got labels %v, want run_id and server", labels)
+	}
+	for idx, want := range [][2]string{{"run_id", "r1"}, {"server", "a"}} {
+		if got := [2]string{labels[idx].GetName(), labels[idx].GetValue()}; got != want {
+			t.Errorf("label %d: got %v, want %v", idx, got, want)
+		}
+	}
+}
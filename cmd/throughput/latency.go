@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robustirc/benchmark/load"
+)
+
+// defaultNativeBucketFactor is the bucket growth factor of
+// -latency_buckets=native, i.e. latencies are exposed with a relative
+// error of at most ~5%.
+const defaultNativeBucketFactor = 1.1
+
+// parseBuckets parses a bucket layout specification, which is one of:
+//
+//	exponential:<start>,<factor>,<count>
+//	linear:<start>,<width>,<count>
+//	<bound>,<bound>,…
+//	native[:<factor>]
+//
+// All values are in seconds. The native layout returns no buckets, but
+// the bucket growth factor of a Prometheus native histogram.
+func parseBuckets(spec string) (buckets []float64, nativeFactor float64, err error) {
+	kind := "explicit"
+	if idx := strings.Index(spec, ":"); idx > -1 {
+		kind = spec[:idx]
+		spec = spec[idx+1:]
+	} else if spec == "native" {
+		return nil, defaultNativeBucketFactor, nil
+	}
+	parts := strings.Split(spec, ",")
+	values := make([]float64, len(parts))
+	for idx, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid bucket value %q: %v", part, err)
+		}
+		values[idx] = v
+	}
+	switch kind {
+	case "explicit":
+		for idx := 1; idx < len(values); idx++ {
+			if values[idx] <= values[idx-1] {
+				return nil, 0, fmt.Errorf("bucket bounds must be increasing, but %v <= %v", values[idx], values[idx-1])
+			}
+		}
+		return values, 0, nil
+
+	case "exponential", "linear":
+		if got, want := len(values), 3; got != want {
+			return nil, 0, fmt.Errorf("%s buckets: unexpected number of parameters: got %d, want %d", kind, got, want)
+		}
+		count := int(values[2])
+		if float64(count) != values[2] || count < 1 {
+			return nil, 0, fmt.Errorf("%s buckets: count must be a positive integer, got %v", kind, values[2])
+		}
+		if kind == "linear" {
+			return prometheus.LinearBuckets(values[0], values[1], count), 0, nil
+		}
+		return prometheus.ExponentialBuckets(values[0], values[1], count), 0, nil
+
+	case "native":
+		if got, want := len(values), 1; got != want {
+			return nil, 0, fmt.Errorf("native buckets: unexpected number of parameters: got %d, want %d", got, want)
+		}
+		if values[0] <= 1 {
+			return nil, 0, fmt.Errorf("native buckets: factor must be greater than 1, got %v", values[0])
+		}
+		return nil, values[0], nil
+	}
+	return nil, 0, fmt.Errorf("unknown bucket layout %q, expected exponential, linear, native or a list of bounds", kind)
+}
+
+func newLatencyReport(h *load.Histogram) latencyReport {
+	result := latencyReport{
+		Unit:      "ms",
+		Count:     h.Count(),
+		Quantiles: make(map[string]float64, len(reportQuantiles)),
+	}
+	for _, q := range reportQuantiles {
+		result.Quantiles[quantileName(q)] = h.Quantile(q).Seconds() * 1000
+	}
+	return result
+}
+
+func logLatencyReport(h *load.Histogram) {
+	quantiles := make([]string, len(reportQuantiles))
+	for idx, q := range reportQuantiles {
+		quantiles[idx] = fmt.Sprintf("%s = %v", quantileName(q), h.Quantile(q))
+	}
+	log.Printf("latency of %d messages: %s", h.Count(), strings.Join(quantiles, ", "))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+func TestParseBuckets(t *testing.T) {
+	for _, tt := range []struct {
+		spec         string
+		buckets      []float64
+		nativeFactor float64
+		wantErr      bool
+	}{
+		{spec: "0.001,0.01,0.1", buckets: []float64{0.001, 0.01, 0.1}},
+		{spec: "exponential:0.001,10,3", buckets: []float64{0.001, 0.01, 0.1}},
+		{spec: "linear:1,1,3", buckets: []float64{1, 2, 3}},
+		{spec: "native", nativeFactor: defaultNativeBucketFactor},
+		{spec: "native:1.5", nativeFactor: 1.5},
+		{spec: "native:1", wantErr: true},
+		{spec: "native:1.1,2", wantErr: true},
+		{spec: "0.1,0.01", wantErr: true},
+		{spec: "sparse:1.1", wantErr: true},
+	} {
+		buckets, nativeFactor, err := parseBuckets(tt.spec)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBuckets(%q): unexpectedly succeeded", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseBuckets(%q): %v", tt.spec, err)
+			continue
+		}
+		// Compare with a tolerance, ExponentialBuckets multiplies.
+		if len(buckets) != len(tt.buckets) {
+			t.Errorf("parseBuckets(%q): got buckets %v, want %v", tt.spec, buckets, tt.buckets)
+		}
+		for idx := range buckets {
+			if idx < len(tt.buckets) && !approximately(buckets[idx], tt.buckets[idx]) {
+				t.Errorf("parseBuckets(%q): got buckets %v, want %v", tt.spec, buckets, tt.buckets)
+				break
+			}
+		}
+		if nativeFactor != tt.nativeFactor {
+			t.Errorf("parseBuckets(%q): got native factor %v, want %v", tt.spec, nativeFactor, tt.nativeFactor)
+		}
+	}
+}
+
+func approximately(a, b float64) bool {
+	const epsilon = 1e-9
+	return a-b < epsilon && b-a < epsilon
+}
+
+// TestNativeLatencyHistogram verifies that -latency_buckets=native
+// results in a native histogram without classic buckets.
+func TestNativeLatencyHistogram(t *testing.T) {
+	buckets, nativeFactor, err := parseBuckets("native")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := load.New(load.Options{
+		Sessions:                    2,
+		LatencyBuckets:              buckets,
+		NativeHistogramBucketFactor: nativeFactor,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	families, err := r.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != "message_latency_seconds" {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if h.Schema == nil {
+			t.Errorf("message_latency_seconds is not a native histogram: %v", h)
+		}
+		if got := h.GetBucket(); len(got) > 0 {
+			t.Errorf("message_latency_seconds unexpectedly has classic buckets: %v", got)
+		}
+		return
+	}
+	t.Fatalf("message_latency_seconds not found")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/robustirc/robustirc/robusthttp"
+	"github.com/robustirc/robustirc/util"
+)
+
+// networkConfigTimeout bounds how long it may take until all servers
+// serve a config which was applied.
+const networkConfigTimeout = 30 * time.Second
+
+// parseConfigParams parses -network_config_params, e.g.
+// "PostMessageCooloff=0,SessionExpiration=10m0s".
+func parseConfigParams(spec string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, kv := range strings.Split(spec, ",") {
+		if strings.TrimSpace(kv) == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid parameter %q: expected <name>=<value>", kv)
+		}
+		params[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return params, nil
+}
+
+// renderNetworkConfig renders the network config template tmpl, in
+// which params can be referred to, e.g. {{.PostMessageCooloff}}.
+// Referring to a parameter which is not specified is an error.
+func renderNetworkConfig(tmpl string, params map[string]string) (string, error) {
+	t, err := template.New("network config").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, params); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// readNetworkConfig reads and renders -network_config_file.
+func readNetworkConfig(filename, paramSpec string) (string, error) {
+	params, err := parseConfigParams(paramSpec)
+	if err != nil {
+		return "", fmt.Errorf("-network_config_params: %v", err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	config, err := renderNetworkConfig(string(b), params)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", filename, err)
+	}
+	return config, nil
+}
+
+// getNetworkConfig returns the network config served by server. There
+// is no counterpart in util, which only sets the config, see
+// util.SetNetworkConfig.
+func getNetworkConfig(server string) (string, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("https://%s/config", server), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := robusthttp.Client(networkPassword(), true).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if got, want := resp.StatusCode, http.StatusOK; got != want {
+		return "", fmt.Errorf("GET /config: unexpected HTTP status code: got %d, want %d", got, want)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// networkConfigurator changes the network config for the benchmark and
+// restores the config the network had before.
+type networkConfigurator struct {
+	servers []string
+
+	// mu serializes apply and restore, which also runs as exit hook.
+	mu sync.Mutex
+	// original is the config before the first apply.
+	original string
+	saved    bool
+}
+
+// apply sets the network config to config and returns once all servers
+// serve it. The config before the first apply is saved, see restore.
+//
+// One try is sufficient: conflicts in network config setting can only
+// happen when something else/someone else is modifying the network
+// config at the same time. Since the RobustIRC network in question is
+// dedicated to the loadtest, we are the only modifier of configs — and
+// if we unexpectedly aren’t, failing loudly is a good thing.
+func (c *networkConfigurator) apply(config string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.applyLocked(config)
+}
+
+func (c *networkConfigurator) applyLocked(config string) error {
+	if !c.saved {
+		current, err := getNetworkConfig(c.servers[0])
+		if err != nil {
+			return err
+		}
+		c.original = current
+		c.saved = true
+	}
+	if err := util.SetNetworkConfig(c.servers, config, networkPassword()); err != nil {
+		return err
+	}
+	return c.verify(config)
+}
+
+// verify returns once all servers serve config, or an error after
+// networkConfigTimeout.
+func (c *networkConfigurator) verify(config string) error {
+	started := time.Now()
+	for _, server := range c.servers {
+		for {
+			current, err := getNetworkConfig(server)
+			if err == nil && strings.TrimSpace(current) == strings.TrimSpace(config) {
+				break
+			}
+			if err == nil {
+				err = fmt.Errorf("the config was not applied (yet)")
+			}
+			if time.Since(started) > networkConfigTimeout {
+				return fmt.Errorf("%s does not serve the new network config within %v: %v", server, networkConfigTimeout, err)
+			}
+			time.Sleep(1 * time.Second)
+		}
+	}
+	return nil
+}
+
+// restore sets the network config back to what it was before the first
+// apply, if any. Once restored, further calls do nothing until the next
+// apply.
+func (c *networkConfigurator) restore() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.saved {
+		return nil
+	}
+	log.Printf("Restoring the original RobustIRC network configuration")
+	if err := c.applyLocked(c.original); err != nil {
+		return fmt.Errorf("restoring the network config: %v", err)
+	}
+	c.saved = false
+	return nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+)
+
+func TestRenderNetworkConfig(t *testing.T) {
+	params, err := parseConfigParams("PostMessageCooloff=0, SessionExpiration=10m0s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := renderNetworkConfig(`SessionExpiration = "{{.SessionExpiration}}"
+PostMessageCooloff = "{{.PostMessageCooloff}}"
+`, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `SessionExpiration = "10m0s"
+PostMessageCooloff = "0"
+`
+	if got != want {
+		t.Errorf("renderNetworkConfig: got %q, want %q", got, want)
+	}
+
+	if _, err := renderNetworkConfig(`PostMessageCooloff = "{{.Typo}}"`, params); err == nil {
+		t.Errorf("renderNetworkConfig with an unknown parameter unexpectedly succeeded")
+	}
+	if _, err := parseConfigParams("PostMessageCooloff"); err == nil {
+		t.Errorf("parseConfigParams without value unexpectedly succeeded")
+	}
+}
+
+func TestNetworkConfigurator(t *testing.T) {
+	n := fakerobustirc.NewNetwork(3, fakerobustirc.Options{})
+	defer n.Close()
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	caFile, err := n.WriteCAFile(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("tls_ca_file", caFile); err != nil {
+		t.Fatal(err)
+	}
+
+	const original = `SessionExpiration = "30m0s"`
+	n.SetConfig(original)
+
+	c := &networkConfigurator{servers: n.Servers()}
+	if err := c.apply(`PostMessageCooloff = "0"`); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := n.Config(); got != `PostMessageCooloff = "0"` {
+		t.Errorf("after apply: got config %q", got)
+	}
+	if err := c.apply(`PostMessageCooloff = "10ms"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := n.Config(); got != original {
+		t.Errorf("after restore: got config %q, want %q", got, original)
+	}
+
+	// Restoring again (e.g. in the exit hook after the run already
+	// restored the config) does not change the config.
+	_, revision := n.Config()
+	if err := c.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, got := n.Config(); got != revision {
+		t.Errorf("second restore: got config revision %d, want %d", got, revision)
+	}
+}
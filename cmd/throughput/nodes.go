@@ -0,0 +1,37 @@
+package main
+
+import "github.com/robustirc/benchmark/load"
+
+type nodeLatencyReport struct {
+	PostServer    string        `json:"post_server"`
+	ReceiveServer string        `json:"receive_server"`
+	Latency       latencyReport `json:"latency"`
+}
+
+type postLatencyReport struct {
+	Server  string        `json:"server"`
+	Handler string        `json:"handler"`
+	Latency latencyReport `json:"latency"`
+}
+
+// newNodeLatencyReports converts the per-node latencies of a Runner
+// into their report representation.
+func newNodeLatencyReports(messages []load.NodeLatency, posts []load.PostLatency) ([]nodeLatencyReport, []postLatencyReport) {
+	messageReports := make([]nodeLatencyReport, len(messages))
+	for idx, m := range messages {
+		messageReports[idx] = nodeLatencyReport{
+			PostServer:    m.PostServer,
+			ReceiveServer: m.ReceiveServer,
+			Latency:       newLatencyReport(m.Latency),
+		}
+	}
+	postReports := make([]postLatencyReport, len(posts))
+	for idx, p := range posts {
+		postReports[idx] = postLatencyReport{
+			Server:  p.Server,
+			Handler: p.Handler,
+			Latency: newLatencyReport(p.Latency),
+		}
+	}
+	return messageReports, postReports
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/robustirc/benchmark/internal/remotewrite"
+)
+
+// pushJob is the job label of pushed metrics.
+const pushJob = "throughput"
+
+// metricsPusher pushes the metrics of this process to -pushgateway
+// and/or -remote_write, so that they outlive the process.
+type metricsPusher struct {
+	gatherer    prometheus.Gatherer
+	pushgateway *push.Pusher
+	remoteWrite string
+	client      *http.Client
+}
+
+// newMetricsPusher returns nil if neither -pushgateway nor
+// -remote_write are set. labels are attached to all pushed metrics.
+func newMetricsPusher(gatherer prometheus.Gatherer, labels prometheus.Labels) *metricsPusher {
+	if *pushgateway == "" && *remoteWrite == "" {
+		return nil
+	}
+	p := &metricsPusher{
+		gatherer:    labelledGatherer{gatherer, labels},
+		remoteWrite: *remoteWrite,
+		client:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if *pushgateway != "" {
+		// The Pushgateway adds the grouping labels itself and rejects
+		// metrics which already have them.
+		grouped := make(prometheus.Labels, len(labels))
+		for name, value := range labels {
+			if name != "run_id" {
+				grouped[name] = value
+			}
+		}
+		p.pushgateway = push.New(*pushgateway, pushJob).
+			Gatherer(labelledGatherer{gatherer, grouped}).
+			Grouping("run_id", labels["run_id"]).
+			Client(p.client)
+	}
+	return p
+}
+
+// push pushes the current metrics. Errors are logged, as a failed push
+// should not fail the run.
+func (p *metricsPusher) push() {
+	if p.pushgateway != nil {
+		// Push replaces all metrics of this run, so that the
+		// Pushgateway holds the most recent values.
+		if err := p.pushgateway.Push(); err != nil {
+			log.Printf("Pushing metrics to %s: %v", *pushgateway, err)
+		}
+	}
+	if p.remoteWrite != "" {
+		labels := []remotewrite.Label{{Name: "job", Value: pushJob}}
+		series, err := remotewrite.FromGatherer(p.gatherer, labels, time.Now())
+		if err != nil {
+			log.Printf("Gathering metrics: %v", err)
+			return
+		}
+		if err := remotewrite.Write(p.client, p.remoteWrite, series); err != nil {
+			log.Printf("Writing metrics to %s: %v", p.remoteWrite, err)
+		}
+	}
+}
+
+// run pushes the metrics every interval. It never returns.
+func (p *metricsPusher) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		p.push()
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/robustirc/benchmark/internal/remotewrite"
+)
+
+func TestMetricsPusher(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	sent := prometheus.NewCounter(prometheus.CounterOpts{Name: "messages_sent", Help: "h"})
+	sent.Add(42)
+	reg.MustRegister(sent)
+
+	var (
+		mu      sync.Mutex
+		paths   []string
+		pushed  float64
+		written []remotewrite.Series
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			if mf.GetName() == "messages_sent" {
+				pushed = mf.GetMetric()[0].GetCounter().GetValue()
+			}
+		}
+	}))
+	defer gateway.Close()
+	receiver := httptest.NewServer(remotewrite.Handler(func(s []remotewrite.Series) {
+		mu.Lock()
+		defer mu.Unlock()
+		written = s
+	}))
+	defer receiver.Close()
+
+	*pushgateway = gateway.URL
+	*remoteWrite = receiver.URL
+	defer func() {
+		*pushgateway = ""
+		*remoteWrite = ""
+	}()
+	identity = runIdentity{RunID: "run1", ConfigHash: "c0ffee"}
+	newMetricsPusher(reg, identity.constLabels()).push()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := "PUT /metrics/job/throughput/run_id/run1"; len(paths) != 1 || paths[0] != want {
+		t.Errorf("Pushgateway requests: got %v, want [%s]", paths, want)
+	}
+	if pushed != 42 {
+		t.Errorf("pushed messages_sent: got %v, want 42", pushed)
+	}
+	if len(written) != 1 {
+		t.Fatalf("remote-write: got %d series, want 1", len(written))
+	}
+	want := []remotewrite.Label{
+		{Name: "__name__", Value: "messages_sent"},
+		{Name: "config_hash", Value: "c0ffee"},
+		{Name: "job", Value: "throughput"},
+		{Name: "run_id", Value: "run1"},
+	}
+	got := written[0]
+	if len(got.Labels) != len(want) || got.Samples[0].Value != 42 {
+		t.Fatalf("remote-write: got %+v, want labels %+v and value 42", got, want)
+	}
+	for idx := range want {
+		if got.Labels[idx] != want[idx] {
+			t.Errorf("remote-write label %d: got %+v, want %+v", idx, got.Labels[idx], want[idx])
+		}
+	}
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/robustclient"
+	"github.com/robustirc/benchmark/load"
+)
+
+// reportQuantiles are the latency quantiles included in the report.
+var reportQuantiles = []float64{0.5, 0.9, 0.99, 0.999}
+
+type latencyReport struct {
+	Unit      string             `json:"unit"`
+	Count     uint64             `json:"count"`
+	Quantiles map[string]float64 `json:"quantiles"`
+}
+
+// report is the structured result of a throughput run. It is updated
+// while the run progresses, so that a partial report can be served.
+type report struct {
+	mu sync.Mutex
+
+	Identity      runIdentity       `json:"identity"`
+	Started       time.Time         `json:"started"`
+	Finished      time.Time         `json:"finished,omitempty"`
+	Duration      string            `json:"duration"`
+	Config        map[string]string `json:"config"`
+	NetworkConfig string            `json:"network_config,omitempty"`
+	SetupDuration string            `json:"setup_duration"`
+	// Canceled is why the run was canceled (e.g. -max_duration), in
+	// which case the report only covers the run until then.
+	Canceled string `json:"canceled,omitempty"`
+
+	// SessionsServed counts the sessions created per server.
+	SessionsServed map[string]*sessionsServed `json:"sessions_served,omitempty"`
+
+	Series      []load.Second          `json:"series"`
+	Latency     latencyReport          `json:"latency"`
+	Convergence load.Convergence       `json:"convergence"`
+	Accounting  load.AccountingSummary `json:"accounting"`
+
+	// LatencyByNode breaks down the message latency by the server the
+	// message was posted to and the server it was received from.
+	LatencyByNode []nodeLatencyReport `json:"latency_by_node,omitempty"`
+	// PostLatency is the duration of PostMessage requests by server.
+	PostLatency []postLatencyReport `json:"post_latency,omitempty"`
+
+	// Availability is recorded by polling the status of all servers,
+	// see -status_interval.
+	Availability  *availabilityReport `json:"availability,omitempty"`
+	LatencySpikes []latencySpike      `json:"latency_spikes,omitempty"`
+
+	// Sweep compares the variants of a -network_config_sweep. Series
+	// spans all variants, the other results are those of the last one.
+	Sweep []sweepResult `json:"sweep,omitempty"`
+
+	// Comparison compares this run to -baseline.
+	Comparison *baselineComparison `json:"baseline,omitempty"`
+
+	// SLOs are the results of the -slo assertions.
+	SLOs []sloResult `json:"slos,omitempty"`
+
+	Faults []faultReport `json:"faults,omitempty"`
+	// ControlActions were requested via the control API while sending.
+	ControlActions []controlAction `json:"control_actions,omitempty"`
+	Snapshots      []string        `json:"snapshots,omitempty"`
+}
+
+type controlAction struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+}
+
+var runReport = &report{}
+
+// start records the configuration of the run. It must be called after
+// flag.Parse.
+func (r *report) start(networkConfig string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Started = time.Now()
+	r.NetworkConfig = networkConfig
+	r.Config = make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		r.Config[f.Name] = f.Value.String()
+	})
+}
+
+func (r *report) configHash() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return configHash(r.Config, r.NetworkConfig)
+}
+
+func (r *report) setIdentity(id runIdentity) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Identity = id
+}
+
+func (r *report) setCanceled(reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Canceled = reason
+}
+
+func (r *report) setSetupDuration(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.SetupDuration = d.String()
+}
+
+type sessionsServed struct {
+	Sessions uint64 `json:"sessions"`
+	// Proxied is the number of sessions whose creation the server
+	// proxied to the leader.
+	Proxied uint64 `json:"proxied"`
+}
+
+func (r *report) addSessionServed(served robustclient.Served) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.SessionsServed == nil {
+		r.SessionsServed = make(map[string]*sessionsServed)
+	}
+	s, ok := r.SessionsServed[served.Server]
+	if !ok {
+		s = &sessionsServed{}
+		r.SessionsServed[served.Server] = s
+	}
+	s.Sessions++
+	if served.ProxiedTo != "" {
+		s.Proxied++
+	}
+}
+
+// servedSessions returns a copy of SessionsServed, e.g. for merging it
+// into the report of the coordinator of a distributed run.
+func (r *report) servedSessions() map[string]sessionsServed {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	served := make(map[string]sessionsServed, len(r.SessionsServed))
+	for server, s := range r.SessionsServed {
+		served[server] = *s
+	}
+	return served
+}
+
+// mergeSessionsServed adds the sessions served of another process of a
+// distributed run (see servedSessions).
+func (r *report) mergeSessionsServed(served map[string]sessionsServed) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for server, other := range served {
+		if r.SessionsServed == nil {
+			r.SessionsServed = make(map[string]*sessionsServed)
+		}
+		s, ok := r.SessionsServed[server]
+		if !ok {
+			s = &sessionsServed{}
+			r.SessionsServed[server] = s
+		}
+		s.Sessions += other.Sessions
+		s.Proxied += other.Proxied
+	}
+}
+
+func (r *report) setFaults(faults []faultReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Faults = faults
+}
+
+func (r *report) addSample(sample load.Second) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Series = append(r.Series, sample)
+}
+
+// seriesLen returns the number of seconds recorded so far.
+func (r *report) seriesLen() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.Series)
+}
+
+// addSweepResult records res, whose mean rates are computed from the
+// seconds recorded since the first seconds.
+func (r *report) addSweepResult(res sweepResult, first int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res.MeanSent, res.MeanReceived = meanRates(r.Series[first:])
+	r.Sweep = append(r.Sweep, res)
+}
+
+func (r *report) sweep() []sweepResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]sweepResult(nil), r.Sweep...)
+}
+
+func (r *report) setConvergence(c load.Convergence) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Convergence = c
+}
+
+func (r *report) addControlAction(action string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ControlActions = append(r.ControlActions, controlAction{
+		Time:   time.Now(),
+		Action: action,
+	})
+}
+
+// progress returns the most recent second (nil before sending) and the
+// convergence as of the last check.
+func (r *report) progress() (*load.Second, load.Convergence) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.Series) == 0 {
+		return nil, r.Convergence
+	}
+	last := r.Series[len(r.Series)-1]
+	return &last, r.Convergence
+}
+
+func (r *report) addSnapshot(url string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Snapshots = append(r.Snapshots, url)
+}
+
+func (r *report) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Finished = time.Now()
+}
+
+// refreshLocked updates the fields which are derived from other state,
+// e.g. the latency histogram.
+func (r *report) refreshLocked() {
+	end := r.Finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	r.Duration = end.Sub(r.Started).String()
+	if runner := currentRunner(); runner != nil {
+		r.Accounting = runner.AccountingTotal()
+		r.Latency = newLatencyReport(runner.Latency())
+		r.LatencyByNode, r.PostLatency = newNodeLatencyReports(runner.NodeLatencies())
+	}
+	if nodeStatus != nil {
+		r.Availability = nodeStatus.report(r.Series, end)
+	}
+	r.LatencySpikes = latencySpikes(r.Series, r.Availability)
+	if baselineReport != nil {
+		r.Comparison = compareReports(baselineReport, r, *baselineTolerance, *baselineSignificance)
+	}
+}
+
+func (r *report) comparison() *baselineComparison {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshLocked()
+	return r.Comparison
+}
+
+// meanRates returns the mean number of messages sent and received per
+// second.
+func (r *report) meanRates() (sent, received float64) {
+	return meanRates(r.Series)
+}
+
+// meanRates returns the mean number of messages sent and received per
+// second of series.
+func meanRates(series []load.Second) (sent, received float64) {
+	if len(series) == 0 {
+		return 0, 0
+	}
+	for _, s := range series {
+		sent += float64(s.Sent)
+		received += float64(s.Received)
+	}
+	n := float64(len(series))
+	return sent / n, received / n
+}
+
+// offset formats t relative to the start of the run.
+func (r *report) offset(t time.Time) string {
+	return t.Sub(r.Started).Round(10 * time.Millisecond).String()
+}
+
+func (r *report) JSON() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshLocked()
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// Markdown renders the report for humans. The per-second series is
+// summarized instead of listed.
+func (r *report) Markdown() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshLocked()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# throughput report\n\n")
+	fmt.Fprintf(&buf, "Started %s, ran for %s (setup: %s).\n\n", r.Started.Format(time.RFC3339), r.Duration, r.SetupDuration)
+	if r.Canceled != "" {
+		fmt.Fprintf(&buf, "**The run was canceled (%s), the results are partial.**\n\n", r.Canceled)
+	}
+
+	id := r.Identity
+	fmt.Fprintf(&buf, "| run | |\n|---|---|\n")
+	fmt.Fprintf(&buf, "| run ID | %s |\n", id.RunID)
+	fmt.Fprintf(&buf, "| config hash | %s |\n", id.ConfigHash)
+	if id.BenchmarkRevision != "" {
+		fmt.Fprintf(&buf, "| benchmark revision | %s |\n", id.BenchmarkRevision)
+	}
+	if id.RobustIRCRevision != "" {
+		fmt.Fprintf(&buf, "| robustirc revision | %s |\n", id.RobustIRCRevision)
+	}
+	labelNames := make([]string, 0, len(id.Labels))
+	for name := range id.Labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for _, name := range labelNames {
+		fmt.Fprintf(&buf, "| label %s | %s |\n", name, id.Labels[name])
+	}
+	fmt.Fprintf(&buf, "\n")
+
+	fmt.Fprintf(&buf, "## Results\n\n")
+	fmt.Fprintf(&buf, "| | |\n|---|---|\n")
+	if r.Convergence.Converged {
+		fmt.Fprintf(&buf, "| converged | yes, spread %d (%.1f%%) |\n", r.Convergence.Spread, r.Convergence.Ratio*100)
+	} else {
+		fmt.Fprintf(&buf, "| converged | no |\n")
+	}
+	fmt.Fprintf(&buf, "| received msg/s (last 10s) | min %d, max %d |\n", r.Convergence.Min, r.Convergence.Max)
+	if len(r.Series) > 0 {
+		sent, received := r.meanRates()
+		fmt.Fprintf(&buf, "| mean msg/s | sent %.0f, received %.0f |\n", sent, received)
+	}
+	a := r.Accounting
+	fmt.Fprintf(&buf, "| messages | sent %d, received %d, lost %d, duplicated %d, reordered %d |\n",
+		a.Sent, a.Received, a.Lost, a.Duplicated, a.Reordered)
+	fmt.Fprintf(&buf, "\n")
+
+	if len(r.SLOs) > 0 {
+		fmt.Fprintf(&buf, "## SLOs\n\n")
+		fmt.Fprintf(&buf, "| assertion | value | result |\n|---|---|---|\n")
+		for _, slo := range r.SLOs {
+			result := "pass"
+			if !slo.Passed {
+				result = "**FAIL**"
+			}
+			fmt.Fprintf(&buf, "| `%s` | %g | %s |\n", slo.Assertion, slo.Value, result)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if len(r.Sweep) > 0 {
+		fmt.Fprintf(&buf, "## Network config sweep\n\n")
+		fmt.Fprintf(&buf, "The results above are those of the last variant.\n\n")
+		fmt.Fprintf(&buf, "| variant | duration | converged | mean msg/s | lost |")
+		for _, q := range reportQuantiles {
+			fmt.Fprintf(&buf, " %s (%s) |", quantileName(q), r.Latency.Unit)
+		}
+		fmt.Fprintf(&buf, "\n|---|---|---|---|---|%s\n", strings.Repeat("---|", len(reportQuantiles)))
+		for _, res := range r.Sweep {
+			if res.Error != "" {
+				fmt.Fprintf(&buf, "| `%s` | %s | **failed: %s** | | |%s\n", res.Params, res.Duration, res.Error, strings.Repeat(" |", len(reportQuantiles)))
+				continue
+			}
+			converged := "no"
+			if res.Convergence.Converged {
+				converged = fmt.Sprintf("yes, spread %.1f%%", res.Convergence.Ratio*100)
+			}
+			fmt.Fprintf(&buf, "| `%s` | %s | %s | sent %.0f, received %.0f | %d |",
+				res.Params, res.Duration, converged, res.MeanSent, res.MeanReceived, res.Accounting.Lost)
+			for _, q := range reportQuantiles {
+				fmt.Fprintf(&buf, " %.3f |", res.Latency.Quantiles[quantileName(q)])
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if c := r.Comparison; c != nil {
+		fmt.Fprintf(&buf, "## Comparison with baseline\n\n")
+		fmt.Fprintf(&buf, "Compared to the run started %s: %d regressions (tolerance %.1f%%, significance level %g).\n\n",
+			c.BaselineStarted.Format(time.RFC3339), c.Regressions, c.Tolerance*100, c.Significance)
+		fmt.Fprintf(&buf, "| metric | baseline | current | change | p-value | |\n|---|---|---|---|---|---|\n")
+		for _, m := range c.Metrics {
+			p := "n/a"
+			if m.PValue != nil {
+				p = fmt.Sprintf("%.3g", *m.PValue)
+			}
+			verdict := ""
+			if m.Regression {
+				verdict = "**regression**"
+			} else if m.Improvement {
+				verdict = "improvement"
+			}
+			fmt.Fprintf(&buf, "| %s | %.3f | %.3f | %+.1f%% | %s | %s |\n", m.Metric, m.Baseline, m.Current, m.Change*100, p, verdict)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if len(r.SessionsServed) > 0 {
+		fmt.Fprintf(&buf, "## Sessions per server\n\n")
+		fmt.Fprintf(&buf, "| server | sessions | proxied to leader |\n|---|---|---|\n")
+		servers := make([]string, 0, len(r.SessionsServed))
+		for server := range r.SessionsServed {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for _, server := range servers {
+			s := r.SessionsServed[server]
+			fmt.Fprintf(&buf, "| %s | %d | %d |\n", server, s.Sessions, s.Proxied)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	fmt.Fprintf(&buf, "## Latency\n\n")
+	fmt.Fprintf(&buf, "%d messages.\n\n", r.Latency.Count)
+	fmt.Fprintf(&buf, "| quantile | latency (%s) |\n|---|---|\n", r.Latency.Unit)
+	for _, q := range reportQuantiles {
+		name := quantileName(q)
+		fmt.Fprintf(&buf, "| %s | %.3f |\n", name, r.Latency.Quantiles[name])
+	}
+	fmt.Fprintf(&buf, "\n")
+
+	if len(r.LatencyByNode) > 0 || len(r.PostLatency) > 0 {
+		fmt.Fprintf(&buf, "## Latency by node\n\n")
+		fmt.Fprintf(&buf, "| posted to | received from | messages |")
+		for _, q := range reportQuantiles {
+			fmt.Fprintf(&buf, " %s (%s) |", quantileName(q), r.Latency.Unit)
+		}
+		fmt.Fprintf(&buf, "\n|---|---|---|%s\n", strings.Repeat("---|", len(reportQuantiles)))
+		for _, l := range r.LatencyByNode {
+			fmt.Fprintf(&buf, "| %s | %s | %d |", l.PostServer, l.ReceiveServer, l.Latency.Count)
+			for _, q := range reportQuantiles {
+				fmt.Fprintf(&buf, " %.3f |", l.Latency.Quantiles[quantileName(q)])
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		fmt.Fprintf(&buf, "\nPostMessage requests:\n\n")
+		fmt.Fprintf(&buf, "| server | handled by | requests |")
+		for _, q := range reportQuantiles {
+			fmt.Fprintf(&buf, " %s (%s) |", quantileName(q), r.Latency.Unit)
+		}
+		fmt.Fprintf(&buf, "\n|---|---|---|%s\n", strings.Repeat("---|", len(reportQuantiles)))
+		for _, l := range r.PostLatency {
+			fmt.Fprintf(&buf, "| %s | %s | %d |", l.Server, l.Handler, l.Latency.Count)
+			for _, q := range reportQuantiles {
+				fmt.Fprintf(&buf, " %.3f |", l.Latency.Quantiles[quantileName(q)])
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if a := r.Availability; a != nil {
+		fmt.Fprintf(&buf, "## Availability\n\n")
+		fmt.Fprintf(&buf, "%d leader changes, %d periods without leader, %d node state changes.\n\n",
+			len(a.LeaderChanges), len(a.Leaderless), len(a.StateChanges))
+		if len(a.LeaderChanges) > 0 {
+			fmt.Fprintf(&buf, "| at | from | to | max p99 (ms) |\n|---|---|---|---|\n")
+			for _, c := range a.LeaderChanges {
+				fmt.Fprintf(&buf, "| %s | %s | %s | %.3f |\n", r.offset(c.Time), c.From, c.To, c.MaxLatencyP99)
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		if len(a.Leaderless) > 0 {
+			fmt.Fprintf(&buf, "| no leader from | until | duration | max p99 (ms) |\n|---|---|---|---|\n")
+			for _, p := range a.Leaderless {
+				until := "end of run"
+				if !p.End.IsZero() {
+					until = r.offset(p.End)
+				}
+				fmt.Fprintf(&buf, "| %s | %s | %s | %.3f |\n", r.offset(p.Start), until, p.Duration, p.MaxLatencyP99)
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+		if len(a.StateChanges) > 0 {
+			fmt.Fprintf(&buf, "| at | server | from | to |\n|---|---|---|---|\n")
+			for _, c := range a.StateChanges {
+				fmt.Fprintf(&buf, "| %s | %s | %s | %s |\n", r.offset(c.Time), c.Server, c.From, c.To)
+			}
+			fmt.Fprintf(&buf, "\n")
+		}
+	}
+
+	if len(r.LatencySpikes) > 0 {
+		const maxSpikes = 20
+		fmt.Fprintf(&buf, "## Latency spikes\n\n")
+		fmt.Fprintf(&buf, "%d seconds in which the p99 latency exceeded twice the median per-second p99", len(r.LatencySpikes))
+		if len(r.LatencySpikes) > maxSpikes {
+			fmt.Fprintf(&buf, " (showing the first %d)", maxSpikes)
+		}
+		fmt.Fprintf(&buf, ".\n\n")
+		fmt.Fprintf(&buf, "| at | p99 (ms) | max (ms) | availability events |\n|---|---|---|---|\n")
+		for i, s := range r.LatencySpikes {
+			if i == maxSpikes {
+				break
+			}
+			fmt.Fprintf(&buf, "| %s | %.3f | %.3f | %s |\n", r.offset(s.Time), s.LatencyP99, s.LatencyMax, strings.Join(s.Events, ", "))
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if len(r.Faults) > 0 {
+		fmt.Fprintf(&buf, "## Faults\n\n")
+		fmt.Fprintf(&buf, "| at | fault | node | baseline msg/s | recovery | lost |\n|---|---|---|---|---|---|\n")
+		for _, f := range r.Faults {
+			recovery := "not recovered"
+			if f.Recovered {
+				recovery = f.RecoveryTime
+			}
+			if f.Error != "" {
+				recovery = "failed: " + f.Error
+			}
+			fmt.Fprintf(&buf, "| %s | %s %s | %s | %.0f | %s | %d |\n", f.At, f.Action, f.Target, f.Node, f.BaselineRate, recovery, f.Lost)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if len(r.ControlActions) > 0 {
+		fmt.Fprintf(&buf, "## Control actions\n\n")
+		fmt.Fprintf(&buf, "| at | action |\n|---|---|\n")
+		for _, a := range r.ControlActions {
+			fmt.Fprintf(&buf, "| %s | %s |\n", r.offset(a.Time), a.Action)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	if len(r.Snapshots) > 0 {
+		fmt.Fprintf(&buf, "## Dashboard snapshots\n\n")
+		for _, url := range r.Snapshots {
+			fmt.Fprintf(&buf, "* %s\n", url)
+		}
+		fmt.Fprintf(&buf, "\n")
+	}
+
+	fmt.Fprintf(&buf, "## Configuration\n\n")
+	names := make([]string, 0, len(r.Config))
+	for name := range r.Config {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(&buf, "| flag | value |\n|---|---|\n")
+	for _, name := range names {
+		fmt.Fprintf(&buf, "| -%s | `%s` |\n", name, r.Config[name])
+	}
+	if r.NetworkConfig != "" {
+		fmt.Fprintf(&buf, "\nNetwork config:\n\n```toml\n%s\n```\n", r.NetworkConfig)
+	}
+	return buf.Bytes()
+}
+
+// writeFiles writes the report to prefix.json and prefix.md.
+func (r *report) writeFiles(prefix string) error {
+	b, err := r.JSON()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(prefix+".json", b, 0644); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(prefix+".md", r.Markdown(), 0644); err != nil {
+		return err
+	}
+	log.Printf("Report written to %s.json and %s.md", prefix, prefix)
+	return nil
+}
+
+func (r *report) serveJSON(w http.ResponseWriter, _ *http.Request) {
+	b, err := r.JSON()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+func (r *report) serveMarkdown(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.Write(r.Markdown())
+}
+
+func quantileName(q float64) string {
+	return fmt.Sprintf("p%g", q*100)
+}
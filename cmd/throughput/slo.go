@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sloFailedExitCode is the exit code of throughput when at least one
+// SLO assertion failed. It differs from the exit code of log.Fatal, so
+// that CI can distinguish regressions from broken runs.
+const sloFailedExitCode = 3
+
+// sloMetric returns the value of a metric which SLO assertions can refer
+// to. Latencies are in ms.
+type sloMetric func(r *report) float64
+
+var sloMetrics = map[string]sloMetric{
+	"sent_rate": func(r *report) float64 {
+		sent, _ := r.meanRates()
+		return sent
+	},
+	"received_rate": func(r *report) float64 {
+		_, received := r.meanRates()
+		return received
+	},
+	"sent":       func(r *report) float64 { return float64(r.Accounting.Sent) },
+	"received":   func(r *report) float64 { return float64(r.Accounting.Received) },
+	"lost":       func(r *report) float64 { return float64(r.Accounting.Lost) },
+	"duplicated": func(r *report) float64 { return float64(r.Accounting.Duplicated) },
+	"reordered":  func(r *report) float64 { return float64(r.Accounting.Reordered) },
+	"loss_ratio": func(r *report) float64 {
+		if r.Accounting.Sent == 0 {
+			return 0
+		}
+		return float64(r.Accounting.Lost) / float64(r.Accounting.Sent)
+	},
+	"converged": func(r *report) float64 {
+		if r.Convergence.Converged {
+			return 1
+		}
+		return 0
+	},
+	"baseline_regressions": func(r *report) float64 {
+		if r.Comparison == nil {
+			return 0
+		}
+		return float64(r.Comparison.Regressions)
+	},
+	"leader_changes": func(r *report) float64 {
+		if r.Availability == nil {
+			return 0
+		}
+		return float64(len(r.Availability.LeaderChanges))
+	},
+	"leaderless_seconds": func(r *report) float64 {
+		if r.Availability == nil {
+			return 0
+		}
+		var total time.Duration
+		for _, p := range r.Availability.Leaderless {
+			d, _ := time.ParseDuration(p.Duration)
+			total += d
+		}
+		return total.Seconds()
+	},
+}
+
+func init() {
+	for _, q := range reportQuantiles {
+		name := quantileName(q)
+		sloMetrics[name+"_latency"] = func(r *report) float64 {
+			return r.Latency.Quantiles[name]
+		}
+	}
+}
+
+func isLatencyMetric(name string) bool {
+	return strings.HasSuffix(name, "_latency")
+}
+
+var sloOperators = map[string]func(value, threshold float64) bool{
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+type sloAssertion struct {
+	metric    string
+	operator  string
+	threshold float64
+	text      string
+}
+
+var sloAssertionRe = regexp.MustCompile(`^([a-z0-9_.]+)\s*(<=|>=|==|!=|<|>)\s*(\S+)$`)
+
+// parseSLOs parses SLO assertions, which are separated by semicolons
+// or newlines. Each assertion is
+//
+//	<metric> <operator> <threshold>
+//
+// e.g. “p99_latency < 200ms”, “received_rate >= 2000” or “lost == 0”.
+// Thresholds of latency metrics are durations or numbers of ms. Lines
+// starting with # are ignored.
+func parseSLOs(spec string) ([]sloAssertion, error) {
+	var slos []sloAssertion
+	for _, line := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		matches := sloAssertionRe.FindStringSubmatch(line)
+		if matches == nil {
+			return nil, fmt.Errorf("invalid SLO %q: expected <metric> <operator> <threshold>", line)
+		}
+		metric, operator, value := matches[1], matches[2], matches[3]
+		if _, ok := sloMetrics[metric]; !ok {
+			return nil, fmt.Errorf("invalid SLO %q: unknown metric %q, expected one of %s", line, metric, strings.Join(sloMetricNames(), ", "))
+		}
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil && isLatencyMetric(metric) {
+			var d time.Duration
+			d, err = time.ParseDuration(value)
+			threshold = d.Seconds() * 1000
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid SLO %q: invalid threshold %q", line, value)
+		}
+		slos = append(slos, sloAssertion{
+			metric:    metric,
+			operator:  operator,
+			threshold: threshold,
+			text:      line,
+		})
+	}
+	return slos, nil
+}
+
+func sloMetricNames() []string {
+	names := make([]string, 0, len(sloMetrics))
+	for name := range sloMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// readSLOs returns the assertions of -slo and -slo_file.
+func readSLOs(spec, filename string) ([]sloAssertion, error) {
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		spec += "\n" + string(b)
+	}
+	return parseSLOs(spec)
+}
+
+type sloResult struct {
+	Assertion string  `json:"assertion"`
+	Value     float64 `json:"value"`
+	Passed    bool    `json:"passed"`
+}
+
+// checkSLOs evaluates slos against the report, records and logs the
+// results and returns whether all assertions passed.
+func (r *report) checkSLOs(slos []sloAssertion) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshLocked()
+	passed := true
+	r.SLOs = make([]sloResult, 0, len(slos))
+	for _, slo := range slos {
+		value := sloMetrics[slo.metric](r)
+		result := sloResult{
+			Assertion: slo.text,
+			Value:     value,
+			Passed:    sloOperators[slo.operator](value, slo.threshold),
+		}
+		verdict := "PASS"
+		if !result.Passed {
+			verdict = "FAIL"
+			passed = false
+		}
+		log.Printf("SLO %s: %s (%s = %g)", slo.text, verdict, slo.metric, value)
+		r.SLOs = append(r.SLOs, result)
+	}
+	return passed
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+func TestParseSLOs(t *testing.T) {
+	slos, err := parseSLOs("p99_latency < 200ms; received_rate>=2000\n# comment\nlost == 0\np99.9_latency <= 1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sloAssertion{
+		{metric: "p99_latency", operator: "<", threshold: 200, text: "p99_latency < 200ms"},
+		{metric: "received_rate", operator: ">=", threshold: 2000, text: "received_rate>=2000"},
+		{metric: "lost", operator: "==", threshold: 0, text: "lost == 0"},
+		{metric: "p99.9_latency", operator: "<=", threshold: 1.5, text: "p99.9_latency <= 1.5"},
+	}
+	if len(slos) != len(want) {
+		t.Fatalf("parseSLOs: got %d assertions, want %d", len(slos), len(want))
+	}
+	for idx := range want {
+		if slos[idx] != want[idx] {
+			t.Errorf("parseSLOs: assertion %d: got %+v, want %+v", idx, slos[idx], want[idx])
+		}
+	}
+
+	for _, spec := range []string{
+		"p99_latency",
+		"p42_latency < 1s",
+		"lost = 0",
+		"lost == none",
+		"received_rate >= 2s",
+	} {
+		if _, err := parseSLOs(spec); err == nil {
+			t.Errorf("parseSLOs(%q) unexpectedly succeeded", spec)
+		}
+	}
+}
+
+func TestCheckSLOs(t *testing.T) {
+	slos, err := parseSLOs("p99_latency < 200ms; received_rate >= 2000; lost == 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &report{
+		Started:  time.Now(),
+		Finished: time.Now(),
+		Series: []load.Second{
+			{Sent: 2000, Received: 2000},
+			{Sent: 3000, Received: 3000},
+		},
+	}
+	// Without a runner (currentRunner() returns nil in tests),
+	// refreshLocked leaves Latency and Accounting at their zero values,
+	// so only the rates can fail.
+	if !r.checkSLOs(slos) {
+		t.Errorf("checkSLOs: got %+v, want all passed", r.SLOs)
+	}
+
+	r.Series = r.Series[:1]
+	r.Series[0].Received = 1000
+	if r.checkSLOs(slos) {
+		t.Fatalf("checkSLOs unexpectedly passed")
+	}
+	if got := r.SLOs[1]; got.Passed || got.Value != 1000 {
+		t.Errorf("checkSLOs: got %+v, want received_rate failed with value 1000", got)
+	}
+}
+
+// TestSLOHelp ensures that -slo documents all metrics.
+func TestSLOHelp(t *testing.T) {
+	usage := flag.Lookup("slo").Usage
+	for name := range sloMetrics {
+		if !strings.Contains(usage, name) {
+			t.Errorf("-slo help does not mention metric %q", name)
+		}
+	}
+}
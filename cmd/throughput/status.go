@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robustirc/benchmark/load"
+	"github.com/robustirc/robustirc/util"
+)
+
+// unreachableState is recorded for nodes whose status could not be
+// retrieved within one -status_interval.
+const unreachableState = "unreachable"
+
+// correlationWindow is how long after an availability event (e.g. a
+// leader election) latency spikes are attributed to it: messages which
+// were posted during an election are only received after it.
+const correlationWindow = 2 * time.Second
+
+var (
+	nodeRaftStateMetric = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "node_raft_state",
+			Help: "1 for the raft state (or unreachable) each RobustIRC server was last seen in, 0 for its previous states",
+		},
+		[]string{"server", "state"})
+
+	leaderChangesMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "leader_changes_total",
+		Help: "Number of times a different RobustIRC server became raft leader during the run",
+	})
+
+	hasLeaderMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "network_has_leader",
+		Help: "1 if one of the RobustIRC servers was raft leader at the last status poll, 0 otherwise",
+	})
+
+	leaderlessSecondsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "leaderless_seconds_total",
+		Help: "Time in seconds during which no RobustIRC server was raft leader, as observed by status polls",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(nodeRaftStateMetric)
+	prometheus.MustRegister(leaderChangesMetric)
+	prometheus.MustRegister(hasLeaderMetric)
+	prometheus.MustRegister(leaderlessSecondsMetric)
+}
+
+// nodeStatus is set up by main unless -status_interval is 0.
+var nodeStatus *statusTracker
+
+type nodeStateChange struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+}
+
+type leaderChange struct {
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+
+	// MaxLatencyP99 is the highest per-second p99 message latency (in
+	// ms) within correlationWindow after the change.
+	MaxLatencyP99 float64 `json:"max_latency_p99_ms"`
+}
+
+type leaderlessPeriod struct {
+	Start time.Time `json:"start"`
+	// End is zero if the network had no leader when the run ended.
+	End      time.Time `json:"end,omitempty"`
+	Duration string    `json:"duration"`
+
+	// MaxLatencyP99 is the highest per-second p99 message latency (in
+	// ms) during the period and within correlationWindow after it.
+	MaxLatencyP99 float64 `json:"max_latency_p99_ms"`
+}
+
+type availabilityReport struct {
+	LeaderChanges []leaderChange     `json:"leader_changes"`
+	Leaderless    []leaderlessPeriod `json:"leaderless_periods"`
+	StateChanges  []nodeStateChange  `json:"state_changes"`
+}
+
+// latencySpike is a second in which the p99 message latency exceeded
+// twice the median per-second p99.
+type latencySpike struct {
+	Time       time.Time `json:"time"`
+	LatencyP99 float64   `json:"latency_p99_ms"`
+	LatencyMax float64   `json:"latency_max_ms"`
+	// Events describes the availability events which happened while
+	// the messages received in this second were in flight.
+	Events []string `json:"events,omitempty"`
+}
+
+// statusTracker polls the status of all RobustIRC servers and records
+// their raft states, leader changes and periods without leader.
+type statusTracker struct {
+	servers []string
+
+	// inflight holds the pending status request per server. It is only
+	// accessed by poll.
+	inflight map[string]chan string
+
+	mu           sync.Mutex
+	states       map[string]string
+	polled       bool
+	lastPoll     time.Time
+	leader       string // current leader, empty if none
+	lastLeader   string // most recent leader, even while there is none
+	stateChanges []nodeStateChange
+	changes      []leaderChange
+	leaderless   []leaderlessPeriod
+}
+
+func newStatusTracker(servers []string) *statusTracker {
+	return &statusTracker{
+		servers:  servers,
+		inflight: make(map[string]chan string),
+		states:   make(map[string]string),
+	}
+}
+
+func serverState(server string) string {
+	status, err := util.GetServerStatus(server, networkPassword())
+	if err != nil {
+		return unreachableState
+	}
+	return status.State
+}
+
+// poll polls the status of all servers every interval. It never
+// returns.
+func (s *statusTracker) poll(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.update(time.Now(), s.round(interval))
+	}
+}
+
+// round retrieves the state of all servers in parallel. Servers which
+// do not respond within timeout are considered unreachable. Their
+// request is not abandoned, but its result is used by a later round,
+// so that a hanging server does not accumulate requests.
+func (s *statusTracker) round(timeout time.Duration) map[string]string {
+	for _, server := range s.servers {
+		if s.inflight[server] != nil {
+			continue
+		}
+		ch := make(chan string, 1)
+		s.inflight[server] = ch
+		go func(server string) {
+			ch <- serverState(server)
+		}(server)
+	}
+	states := make(map[string]string, len(s.servers))
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	expired := false
+	for _, server := range s.servers {
+		ch := s.inflight[server]
+		if !expired {
+			select {
+			case state := <-ch:
+				states[server] = state
+				s.inflight[server] = nil
+				continue
+			case <-timer.C:
+				expired = true
+			}
+		}
+		select {
+		case state := <-ch:
+			states[server] = state
+			s.inflight[server] = nil
+		default:
+			states[server] = unreachableState
+		}
+	}
+	return states
+}
+
+func (s *statusTracker) update(now time.Time, states map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	leader := ""
+	for _, server := range s.servers {
+		state := states[server]
+		if state == "Leader" && leader == "" {
+			leader = server
+		}
+		prev, ok := s.states[server]
+		if ok && prev == state {
+			continue
+		}
+		if ok {
+			log.Printf("Node %s: %s → %s", server, prev, state)
+			s.stateChanges = append(s.stateChanges, nodeStateChange{
+				Time:   now,
+				Server: server,
+				From:   prev,
+				To:     state,
+			})
+			nodeRaftStateMetric.WithLabelValues(server, prev).Set(0)
+		}
+		nodeRaftStateMetric.WithLabelValues(server, state).Set(1)
+		s.states[server] = state
+	}
+
+	if leader == "" {
+		hasLeaderMetric.Set(0)
+		if s.polled && s.leader == "" {
+			leaderlessSecondsMetric.Add(now.Sub(s.lastPoll).Seconds())
+		}
+		if !s.polled || s.leader != "" {
+			log.Printf("No leader")
+			s.leaderless = append(s.leaderless, leaderlessPeriod{Start: now})
+		}
+	} else {
+		hasLeaderMetric.Set(1)
+		if n := len(s.leaderless); n > 0 && s.leaderless[n-1].End.IsZero() {
+			s.leaderless[n-1].End = now
+			log.Printf("Leader %s elected after %v without leader", leader, now.Sub(s.leaderless[n-1].Start))
+		}
+		if s.lastLeader != "" && leader != s.lastLeader {
+			log.Printf("Leader changed from %s to %s", s.lastLeader, leader)
+			leaderChangesMetric.Inc()
+			s.changes = append(s.changes, leaderChange{
+				Time: now,
+				From: s.lastLeader,
+				To:   leader,
+			})
+		}
+		s.lastLeader = leader
+	}
+	s.leader = leader
+	s.lastPoll = now
+	s.polled = true
+}
+
+// report returns the availability events so far, correlated with the
+// per-second latencies in series. Periods without leader which have not
+// ended yet last until end.
+func (s *statusTracker) report(series []load.Second, end time.Time) *availabilityReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := &availabilityReport{
+		LeaderChanges: append([]leaderChange{}, s.changes...),
+		Leaderless:    append([]leaderlessPeriod{}, s.leaderless...),
+		StateChanges:  append([]nodeStateChange{}, s.stateChanges...),
+	}
+	for i, c := range r.LeaderChanges {
+		r.LeaderChanges[i].MaxLatencyP99 = maxLatencyP99(series, c.Time, c.Time)
+	}
+	for i, p := range r.Leaderless {
+		periodEnd := p.End
+		if periodEnd.IsZero() {
+			periodEnd = end
+		}
+		r.Leaderless[i].Duration = periodEnd.Sub(p.Start).String()
+		r.Leaderless[i].MaxLatencyP99 = maxLatencyP99(series, p.Start, periodEnd)
+	}
+	return r
+}
+
+// maxLatencyP99 returns the highest p99 latency of the seconds between
+// from and correlationWindow after to.
+func maxLatencyP99(series []load.Second, from, to time.Time) float64 {
+	var max float64
+	for _, s := range series {
+		// s covers the second before s.Time.
+		if s.Time.Before(from) || s.Time.After(to.Add(correlationWindow+time.Second)) {
+			continue
+		}
+		if s.LatencyP99 > max {
+			max = s.LatencyP99
+		}
+	}
+	return max
+}
+
+// latencySpikes returns the seconds of series in which the p99 latency
+// exceeded twice the median per-second p99, annotated with the events
+// of a (which may be nil) that plausibly caused them.
+func latencySpikes(series []load.Second, a *availabilityReport) []latencySpike {
+	var p99s []float64
+	for _, s := range series {
+		if s.LatencyP99 > 0 {
+			p99s = append(p99s, s.LatencyP99)
+		}
+	}
+	if len(p99s) == 0 {
+		return nil
+	}
+	sort.Float64s(p99s)
+	threshold := 2 * p99s[len(p99s)/2]
+	var spikes []latencySpike
+	for _, s := range series {
+		if s.LatencyP99 <= threshold {
+			continue
+		}
+		spike := latencySpike{
+			Time:       s.Time,
+			LatencyP99: s.LatencyP99,
+			LatencyMax: s.LatencyMax,
+		}
+		if a != nil {
+			// Include all events which happened while the slowest
+			// message received in this second was in flight.
+			inFlight := time.Duration(s.LatencyMax * float64(time.Millisecond))
+			spike.Events = availabilityEvents(a, s.Time.Add(-time.Second-inFlight), s.Time)
+		}
+		spikes = append(spikes, spike)
+	}
+	return spikes
+}
+
+// availabilityEvents describes the events of a between from and to.
+func availabilityEvents(a *availabilityReport, from, to time.Time) []string {
+	within := func(t time.Time) bool {
+		return !t.Before(from) && !t.After(to)
+	}
+	var events []string
+	for _, p := range a.Leaderless {
+		if p.Start.After(to) || (!p.End.IsZero() && p.End.Before(from)) {
+			continue
+		}
+		events = append(events, "no leader")
+		break
+	}
+	for _, c := range a.LeaderChanges {
+		if within(c.Time) {
+			events = append(events, fmt.Sprintf("leader %s → %s", c.From, c.To))
+		}
+	}
+	for _, c := range a.StateChanges {
+		if within(c.Time) {
+			events = append(events, fmt.Sprintf("%s %s → %s", c.Server, c.From, c.To))
+		}
+	}
+	return events
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+	"github.com/robustirc/benchmark/load"
+)
+
+var statusBase = time.Date(2020, 6, 30, 17, 45, 0, 0, time.UTC)
+
+// at returns the time sec seconds into a test run.
+func at(sec float64) time.Time {
+	return statusBase.Add(time.Duration(sec * float64(time.Second)))
+}
+
+func TestStatusTrackerUpdate(t *testing.T) {
+	type poll struct {
+		at     float64
+		states map[string]string
+	}
+	for _, tt := range []struct {
+		name             string
+		polls            []poll
+		wantChanges      []leaderChange
+		wantLeaderless   []leaderlessPeriod
+		wantStateChanges []nodeStateChange
+	}{
+		{
+			name: "leader change",
+			polls: []poll{
+				{0, map[string]string{"a": "Leader", "b": "Follower"}},
+				{1, map[string]string{"a": "Follower", "b": "Leader"}},
+			},
+			wantChanges: []leaderChange{{Time: at(1), From: "a", To: "b"}},
+			wantStateChanges: []nodeStateChange{
+				{Time: at(1), Server: "a", From: "Leader", To: "Follower"},
+				{Time: at(1), Server: "b", From: "Follower", To: "Leader"},
+			},
+		},
+
+		{
+			name: "election after leader crash",
+			polls: []poll{
+				{0, map[string]string{"a": "Leader", "b": "Follower"}},
+				{1, map[string]string{"a": unreachableState, "b": "Candidate"}},
+				{2, map[string]string{"a": unreachableState, "b": "Candidate"}},
+				{3, map[string]string{"a": unreachableState, "b": "Leader"}},
+			},
+			wantChanges:    []leaderChange{{Time: at(3), From: "a", To: "b"}},
+			wantLeaderless: []leaderlessPeriod{{Start: at(1), End: at(3)}},
+			wantStateChanges: []nodeStateChange{
+				{Time: at(1), Server: "a", From: "Leader", To: unreachableState},
+				{Time: at(1), Server: "b", From: "Follower", To: "Candidate"},
+				{Time: at(3), Server: "b", From: "Candidate", To: "Leader"},
+			},
+		},
+
+		{
+			name: "same leader re-elected",
+			polls: []poll{
+				{0, map[string]string{"a": "Leader", "b": "Follower"}},
+				{1, map[string]string{"a": "Candidate", "b": "Candidate"}},
+				{2, map[string]string{"a": "Leader", "b": "Follower"}},
+			},
+			wantLeaderless: []leaderlessPeriod{{Start: at(1), End: at(2)}},
+			wantStateChanges: []nodeStateChange{
+				{Time: at(1), Server: "a", From: "Leader", To: "Candidate"},
+				{Time: at(1), Server: "b", From: "Follower", To: "Candidate"},
+				{Time: at(2), Server: "a", From: "Candidate", To: "Leader"},
+				{Time: at(2), Server: "b", From: "Candidate", To: "Follower"},
+			},
+		},
+
+		{
+			// The first leader is not a leader change.
+			name: "no leader initially",
+			polls: []poll{
+				{0, map[string]string{"a": "Candidate", "b": "Candidate"}},
+				{1, map[string]string{"a": "Candidate", "b": "Candidate"}},
+				{2, map[string]string{"a": "Follower", "b": "Leader"}},
+			},
+			wantLeaderless: []leaderlessPeriod{{Start: at(0), End: at(2)}},
+			wantStateChanges: []nodeStateChange{
+				{Time: at(2), Server: "a", From: "Candidate", To: "Follower"},
+				{Time: at(2), Server: "b", From: "Candidate", To: "Leader"},
+			},
+		},
+
+		{
+			name: "no leader at the end",
+			polls: []poll{
+				{0, map[string]string{"a": "Leader", "b": "Follower"}},
+				{1, map[string]string{"a": unreachableState, "b": "Candidate"}},
+				{2, map[string]string{"a": unreachableState, "b": "Candidate"}},
+			},
+			wantLeaderless: []leaderlessPeriod{{Start: at(1)}},
+			wantStateChanges: []nodeStateChange{
+				{Time: at(1), Server: "a", From: "Leader", To: unreachableState},
+				{Time: at(1), Server: "b", From: "Follower", To: "Candidate"},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStatusTracker([]string{"a", "b"})
+			for _, p := range tt.polls {
+				s.update(at(p.at), p.states)
+			}
+			if !reflect.DeepEqual(s.changes, tt.wantChanges) {
+				t.Errorf("leader changes: got %+v, want %+v", s.changes, tt.wantChanges)
+			}
+			if !reflect.DeepEqual(s.leaderless, tt.wantLeaderless) {
+				t.Errorf("leaderless periods: got %+v, want %+v", s.leaderless, tt.wantLeaderless)
+			}
+			if !reflect.DeepEqual(s.stateChanges, tt.wantStateChanges) {
+				t.Errorf("state changes: got %+v, want %+v", s.stateChanges, tt.wantStateChanges)
+			}
+		})
+	}
+}
+
+func TestStatusTrackerReport(t *testing.T) {
+	s := newStatusTracker([]string{"a", "b"})
+	s.update(at(0), map[string]string{"a": "Leader", "b": "Follower"})
+	s.update(at(10), map[string]string{"a": unreachableState, "b": "Candidate"})
+	s.update(at(12), map[string]string{"a": unreachableState, "b": "Leader"})
+	s.update(at(20), map[string]string{"a": unreachableState, "b": unreachableState})
+
+	series := []load.Second{
+		{Time: at(10), LatencyP99: 5},
+		{Time: at(12), LatencyP99: 2000},
+		// Within correlationWindow after the election.
+		{Time: at(15), LatencyP99: 500},
+		{Time: at(16), LatencyP99: 5},
+		{Time: at(21), LatencyP99: 3000},
+	}
+	got := s.report(series, at(25))
+	wantChanges := []leaderChange{{Time: at(12), From: "a", To: "b", MaxLatencyP99: 2000}}
+	if !reflect.DeepEqual(got.LeaderChanges, wantChanges) {
+		t.Errorf("leader changes: got %+v, want %+v", got.LeaderChanges, wantChanges)
+	}
+	wantLeaderless := []leaderlessPeriod{
+		{Start: at(10), End: at(12), Duration: "2s", MaxLatencyP99: 2000},
+		// Not ended yet, i.e. lasts until the end of the report.
+		{Start: at(20), Duration: "5s", MaxLatencyP99: 3000},
+	}
+	if !reflect.DeepEqual(got.Leaderless, wantLeaderless) {
+		t.Errorf("leaderless periods: got %+v, want %+v", got.Leaderless, wantLeaderless)
+	}
+	if got, want := len(got.StateChanges), 4; got != want {
+		t.Errorf("state changes: got %d, want %d", got, want)
+	}
+
+	// The report is a copy.
+	got.LeaderChanges[0].MaxLatencyP99 = 0
+	if s.changes[0].MaxLatencyP99 != 0 {
+		t.Errorf("report modified the tracker state")
+	}
+}
+
+func TestAvailabilityEvents(t *testing.T) {
+	a := &availabilityReport{
+		Leaderless: []leaderlessPeriod{
+			{Start: at(10), End: at(12)},
+			{Start: at(30)},
+		},
+		LeaderChanges: []leaderChange{{Time: at(12), From: "a", To: "b"}},
+		StateChanges: []nodeStateChange{
+			{Time: at(10), Server: "a", From: "Leader", To: unreachableState},
+		},
+	}
+	for _, tt := range []struct {
+		from, to float64
+		want     []string
+	}{
+		{0, 9, nil},
+		{9, 10, []string{"no leader", "a Leader → unreachable"}},
+		{11, 11.5, []string{"no leader"}},
+		{11.5, 13, []string{"no leader", "leader a → b"}},
+		{12.5, 29, nil},
+		// A period which has not ended covers everything after its start.
+		{40, 41, []string{"no leader"}},
+	} {
+		got := availabilityEvents(a, at(tt.from), at(tt.to))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("availabilityEvents(%vs, %vs): got %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestLatencySpikes(t *testing.T) {
+	a := &availabilityReport{
+		Leaderless:    []leaderlessPeriod{{Start: at(10), End: at(12)}},
+		LeaderChanges: []leaderChange{{Time: at(12), From: "a", To: "b"}},
+	}
+	series := []load.Second{
+		{Time: at(1), LatencyP99: 10, LatencyMax: 12},
+		{Time: at(2), LatencyP99: 11, LatencyMax: 15},
+		// Not a spike: at most twice the median p99 (11).
+		{Time: at(3), LatencyP99: 20, LatencyMax: 30},
+		{Time: at(4), LatencyP99: 9, LatencyMax: 10},
+		{Time: at(5), LatencyP99: 10, LatencyMax: 11},
+		// The slowest message of this second was posted at 10.5s,
+		// i.e. while there was no leader.
+		{Time: at(14), LatencyP99: 1800, LatencyMax: 2500},
+		// A spike without any availability event.
+		{Time: at(20), LatencyP99: 50, LatencyMax: 60},
+		// No messages received, which does not count for the median.
+		{Time: at(21)},
+	}
+	want := []latencySpike{
+		{Time: at(14), LatencyP99: 1800, LatencyMax: 2500, Events: []string{"no leader", "leader a → b"}},
+		{Time: at(20), LatencyP99: 50, LatencyMax: 60},
+	}
+	if got := latencySpikes(series, a); !reflect.DeepEqual(got, want) {
+		t.Errorf("latencySpikes: got %+v, want %+v", got, want)
+	}
+
+	// Without status tracking, spikes are not attributed.
+	for _, spike := range latencySpikes(series, nil) {
+		if spike.Events != nil {
+			t.Errorf("latencySpikes without availability report: got events %q for %v", spike.Events, spike.Time)
+		}
+	}
+	if got := latencySpikes(nil, a); got != nil {
+		t.Errorf("latencySpikes without samples: got %+v, want nil", got)
+	}
+}
+
+func TestStatusTrackerRound(t *testing.T) {
+	n := fakerobustirc.NewNetwork(2, fakerobustirc.Options{})
+	defer n.Close()
+
+	// hanging only responds to status requests once released.
+	release := make(chan bool)
+	var requests int32
+	hanging := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct{ State string }{"Follower"})
+	}))
+	defer hanging.Close()
+
+	// All httptest servers share a certificate, see WriteCAFile.
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	caFile, err := n.WriteCAFile(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := flag.Set("tls_ca_file", caFile); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := append(n.Servers(), strings.TrimPrefix(hanging.URL, "https://"))
+	n.StopNode(1)
+	s := newStatusTracker(servers)
+	got := s.round(500 * time.Millisecond)
+	want := map[string]string{
+		servers[0]: "Leader",
+		servers[1]: unreachableState,
+		servers[2]: unreachableState,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("round with a stopped and a hanging server: got %v, want %v", got, want)
+	}
+
+	// The pending request of the hanging server is picked up by the
+	// next round instead of sending another one.
+	close(release)
+	n.StartNode(1)
+	got = s.round(5 * time.Second)
+	want = map[string]string{
+		servers[0]: "Leader",
+		servers[1]: "Follower",
+		servers[2]: "Follower",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round after recovery: got %v, want %v", got, want)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Errorf("hanging server: got %d status requests, want 1", got)
+	}
+}
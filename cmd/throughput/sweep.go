@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+// configVariant is one network config of a -network_config_sweep.
+type configVariant struct {
+	// Params are the parameters which distinguish the variant, e.g.
+	// "PostMessageCooloff=10ms".
+	Params string
+	Config string
+}
+
+// readConfigSweep reads the -network_config_file template and renders it
+// once for each variant of sweepSpec, e.g.
+// "PostMessageCooloff=0;PostMessageCooloff=10ms". The parameters of a
+// variant override those of paramSpec (-network_config_params).
+func readConfigSweep(filename, paramSpec, sweepSpec string) (tmpl string, variants []configVariant, err error) {
+	base, err := parseConfigParams(paramSpec)
+	if err != nil {
+		return "", nil, fmt.Errorf("-network_config_params: %v", err)
+	}
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	tmpl = string(b)
+	for _, spec := range strings.Split(sweepSpec, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		overrides, err := parseConfigParams(spec)
+		if err != nil {
+			return "", nil, fmt.Errorf("-network_config_sweep: %v", err)
+		}
+		params := make(map[string]string, len(base)+len(overrides))
+		for name, value := range base {
+			params[name] = value
+		}
+		for name, value := range overrides {
+			params[name] = value
+		}
+		config, err := renderNetworkConfig(tmpl, params)
+		if err != nil {
+			return "", nil, fmt.Errorf("%s (variant %q): %v", filename, spec, err)
+		}
+		variants = append(variants, configVariant{
+			Params: spec,
+			Config: config,
+		})
+	}
+	if len(variants) == 0 {
+		return "", nil, fmt.Errorf("-network_config_sweep: no variants specified")
+	}
+	return tmpl, variants, nil
+}
+
+// sweepPrefix returns the load.Options.Prefix of the variant with index
+// idx, so that sessions of a previous variant which did not quit (yet)
+// do not block the nicknames of the next one.
+func sweepPrefix(idx int) string {
+	return fmt.Sprintf("bench-v%d", idx+1)
+}
+
+// sweepResult is the measurement of one variant of a
+// -network_config_sweep.
+type sweepResult struct {
+	Params        string                 `json:"params"`
+	Prefix        string                 `json:"prefix"`
+	NetworkConfig string                 `json:"network_config"`
+	Started       time.Time              `json:"started"`
+	Duration      string                 `json:"duration"`
+	Convergence   load.Convergence       `json:"convergence"`
+	MeanSent      float64                `json:"mean_sent"`
+	MeanReceived  float64                `json:"mean_received"`
+	Accounting    load.AccountingSummary `json:"accounting"`
+	Latency       latencyReport          `json:"latency"`
+	// Error is why measuring the variant failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// runSweep measures each variant in turn: it applies the variant’s
+// network config and runs the benchmark with new sessions, starting
+// with runner. A variant which fails is recorded and the sweep
+// continues with the next one. If ctx is done, the variant is recorded
+// as canceled, the remaining ones are skipped and ctx.Err() is returned.
+func runSweep(ctx context.Context, configurator *networkConfigurator, variants []configVariant) error {
+	for idx, v := range variants {
+		log.Printf("Network config sweep: variant %d of %d (%s)", idx+1, len(variants), v.Params)
+		if idx > 0 {
+			r, err := newStandaloneRunner(sweepPrefix(idx))
+			if err != nil {
+				return err
+			}
+			setRunner(r)
+		}
+		res := sweepResult{
+			Params:        v.Params,
+			Prefix:        sweepPrefix(idx),
+			NetworkConfig: v.Config,
+			Started:       time.Now(),
+		}
+		first := runReport.seriesLen()
+		err := configurator.apply(v.Config)
+		if err == nil {
+			err = runThroughputTest(ctx)
+		}
+		if reason := cancellation.reason(ctx); reason != "" {
+			res.Error = "canceled: " + reason
+		} else if err != nil {
+			log.Printf("Network config sweep: variant %q failed: %v", v.Params, err)
+			res.Error = err.Error()
+		}
+		res.Duration = time.Since(res.Started).Round(time.Second).String()
+		res.Convergence = runner.Convergence()
+		res.Accounting = runner.AccountingTotal()
+		res.Latency = newLatencyReport(runner.Latency())
+		runReport.addSweepResult(res, first)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	logSweepReport(runReport.sweep())
+	return nil
+}
+
+// logSweepReport logs the comparison of the variants of a
+// -network_config_sweep.
+func logSweepReport(results []sweepResult) {
+	for _, res := range results {
+		if res.Error != "" {
+			log.Printf("sweep %s: failed: %s", res.Params, res.Error)
+			continue
+		}
+		log.Printf("sweep %s: converged = %v, mean received = %.0f msgs/s, p50 = %.3f %s, p99 = %.3f %s, %d messages lost",
+			res.Params, res.Convergence.Converged, res.MeanReceived,
+			res.Latency.Quantiles[quantileName(0.5)], res.Latency.Unit,
+			res.Latency.Quantiles[quantileName(0.99)], res.Latency.Unit,
+			res.Accounting.Lost)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+)
+
+func TestReadConfigSweep(t *testing.T) {
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	filename := filepath.Join(tempdir, "config.toml")
+	const tmpl = `SessionExpiration = "{{.SessionExpiration}}"
+PostMessageCooloff = "{{.PostMessageCooloff}}"
+`
+	if err := ioutil.WriteFile(filename, []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, variants, err := readConfigSweep(filename,
+		"SessionExpiration=10m0s,PostMessageCooloff=0",
+		"PostMessageCooloff=0; PostMessageCooloff=10ms;SessionExpiration=1m0s,PostMessageCooloff=50ms;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != tmpl {
+		t.Errorf("readConfigSweep: got template %q, want %q", got, tmpl)
+	}
+	want := []configVariant{
+		{
+			Params: "PostMessageCooloff=0",
+			Config: "SessionExpiration = \"10m0s\"\nPostMessageCooloff = \"0\"\n",
+		},
+		{
+			Params: "PostMessageCooloff=10ms",
+			Config: "SessionExpiration = \"10m0s\"\nPostMessageCooloff = \"10ms\"\n",
+		},
+		{
+			Params: "SessionExpiration=1m0s,PostMessageCooloff=50ms",
+			Config: "SessionExpiration = \"1m0s\"\nPostMessageCooloff = \"50ms\"\n",
+		},
+	}
+	if len(variants) != len(want) {
+		t.Fatalf("readConfigSweep: got %d variants, want %d: %+v", len(variants), len(want), variants)
+	}
+	for idx := range want {
+		if variants[idx] != want[idx] {
+			t.Errorf("variant %d: got %+v, want %+v", idx, variants[idx], want[idx])
+		}
+	}
+
+	// Every variant needs to provide all parameters.
+	if _, _, err := readConfigSweep(filename, "SessionExpiration=10m0s", "PostMessageCooloff=0;SessionExpiration=1m0s"); err == nil {
+		t.Errorf("readConfigSweep with an incomplete variant unexpectedly succeeded")
+	}
+	if _, _, err := readConfigSweep(filename, "", " ; "); err == nil {
+		t.Errorf("readConfigSweep without variants unexpectedly succeeded")
+	}
+}
+
+func TestSweep(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in -short mode")
+	}
+
+	n := fakerobustirc.NewNetwork(3, fakerobustirc.Options{})
+	defer n.Close()
+	const original = `SessionExpiration = "30m0s"`
+	n.SetConfig(original)
+
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	caFile, err := n.WriteCAFile(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(tempdir, "config.toml")
+	if err := ioutil.WriteFile(filename, []byte(`PostMessageCooloff = "{{.PostMessageCooloff}}"`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, variants, err := readConfigSweep(filename, "", "PostMessageCooloff=0;PostMessageCooloff=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"network":       n.Addr(),
+		"tls_ca_file":   caFile,
+		"sessions":      "3",
+		"channels":      "1",
+		"rate":          "200",
+		"min_duration":  "0",
+		"drain_timeout": "1s",
+		"setup_timeout": "30s",
+		"health_check":  "status",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("flag.Set(%q, %q): %v", name, value, err)
+		}
+	}
+	if err := waitForHealthy(n.Servers()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record the configs the network serves during the sweep.
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		for {
+			config, _ := n.Config()
+			mu.Lock()
+			if len(seen) == 0 || seen[len(seen)-1] != config {
+				seen = append(seen, config)
+			}
+			mu.Unlock()
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+
+	r, err := newStandaloneRunner(sweepPrefix(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previousReport := runReport
+	runReport = &report{}
+	setRunner(r)
+	defer func() {
+		// Do not leave state behind for the tests which follow.
+		runReport = previousReport
+		setRunner(nil)
+	}()
+	configurator := &networkConfigurator{servers: n.Servers()}
+	if err := runSweep(context.Background(), configurator, variants); err != nil {
+		t.Fatal(err)
+	}
+	if err := configurator.restore(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	results := runReport.sweep()
+	if got, want := len(results), len(variants); got != want {
+		t.Fatalf("sweep results: got %d, want %d", got, want)
+	}
+	prefixes := make(map[string]bool)
+	for idx, res := range results {
+		if res.Error != "" {
+			t.Errorf("variant %q failed: %v", res.Params, res.Error)
+		}
+		if res.Params != variants[idx].Params {
+			t.Errorf("result %d: got params %q, want %q", idx, res.Params, variants[idx].Params)
+		}
+		if res.Accounting.Received == 0 {
+			t.Errorf("variant %q: no messages received", res.Params)
+		}
+		prefixes[res.Prefix] = true
+	}
+	if got, want := len(prefixes), len(variants); got != want {
+		t.Errorf("sweep results: got %d different prefixes, want %d", got, want)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{original, variants[0].Config, variants[1].Config, original}
+	if len(seen) != len(want) {
+		t.Fatalf("network configs: got %q, want %q", seen, want)
+	}
+	for idx := range want {
+		if seen[idx] != want[idx] {
+			t.Errorf("network config %d: got %q, want %q", idx, seen[idx], want[idx])
+		}
+	}
+}
@@ -5,7 +5,7 @@ package main
 
 import (
 	"bytes"
-	"container/ring"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -15,8 +15,8 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"runtime"
-	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,15 +24,12 @@ import (
 	api_prometheus "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/robustirc/benchmark/internal/grafana"
-	"github.com/robustirc/bridge/robustsession"
-	"github.com/robustirc/robustirc/util"
-	"gopkg.in/sorcix/irc.v2"
+	"github.com/robustirc/benchmark/internal/trace"
+	"github.com/robustirc/benchmark/load"
 )
 
-// token is an anonymous type used for throttling
-type token struct{}
-
 var (
 	network = flag.String("network",
 		"",
@@ -40,7 +37,15 @@ var (
 
 	networkConfigFile = flag.String("network_config_file",
 		"",
-		"Optional filename to read the RobustIRC network config from.")
+		"Optional filename to read the RobustIRC network config from. The config is applied before the run and the original config is restored when the run finishes. The file is a Go text/template which can refer to -network_config_params, e.g. PostMessageCooloff = \"{{.PostMessageCooloff}}\"")
+
+	networkConfigParams = flag.String("network_config_params",
+		"",
+		"Comma-separated name=value parameters for the -network_config_file template, e.g. PostMessageCooloff=0,SessionExpiration=10m0s")
+
+	networkConfigSweep = flag.String("network_config_sweep",
+		"",
+		`Semicolon-separated list of -network_config_params variants (e.g. "PostMessageCooloff=0;PostMessageCooloff=10ms") to measure one after another, each with new sessions and overriding -network_config_params. The report compares the variants. Requires -network_config_file and -mode=standalone, and cannot be combined with -faults, -slo, -slo_file or -baseline. Each variant uses its own nickname prefix (bench-v1, bench-v2, …)`)
 
 	prometheusAddr = flag.String("prometheus",
 		"",
@@ -52,181 +57,255 @@ var (
 
 	listen = flag.String("listen",
 		"",
-		"(optional) [host]:port to listen on for exporting prometheus metrics via HTTP")
+		"(optional) [host]:port to listen on for exporting prometheus metrics, the report and the control API (/control/status, and with -control_api /control/rate, /control/sessions, /control/snapshot, /control/stop) via HTTP")
+
+	controlAPI = flag.Bool("control_api",
+		false,
+		"Whether to serve the control API endpoints which change the run (/control/rate, /control/sessions, /control/snapshot, /control/stop) on -listen. They are not authenticated, so only enable them if -listen is not reachable by untrusted clients")
+
+	reportPrefix = flag.String("report",
+		"",
+		`(optional) filename prefix (e.g. "/tmp/run1") to write the end-of-run report to, as <prefix>.json and <prefix>.md`)
+
+	linger = flag.Duration("linger",
+		0,
+		"(optional) how long to keep serving -listen (e.g. /report.json) after the run finished")
+
+	clockReference = flag.String("clock_reference",
+		"",
+		`(optional) -listen address (e.g. "10.0.0.1:8080") of another throughput process to synchronize clocks with, for measuring latency of messages sent by other hosts`)
+
+	latencyBuckets = flag.String("latency_buckets",
+		"exponential:0.0001,2,20",
+		`Bucket layout (in seconds) of the message_latency_seconds histogram: "exponential:<start>,<factor>,<count>", "linear:<start>,<width>,<count>", a comma-separated list of upper bounds, or "native[:<factor>]" for a Prometheus native histogram whose buckets grow by <factor> (default 1.1). Native histograms are only scraped via the protobuf format (Prometheus --enable-feature=native-histograms), -remote_write only sends their count and sum`)
+
+	healthCheck = flag.String("health_check",
+		"status",
+		`How to determine that the RobustIRC network is ready for load: "status" requires all servers to be Leader or Follower and to agree on the leader, "roundtrip" additionally requires a test message to round-trip through the network, "none" skips the check. The network password is read from $ROBUSTIRC_NETWORK_PASSWORD`)
+
+	healthTimeout = flag.Duration("health_timeout",
+		1*time.Minute,
+		"How long to wait for the RobustIRC network to pass -health_check")
+
+	healthInterval = flag.Duration("health_interval",
+		1*time.Second,
+		"How long to wait between -health_check attempts")
 
 	minDuration = flag.Duration("min_duration",
 		1*time.Minute,
 		"Minimum test runtime, regardless of whether the min/max rates have converged yet")
 
+	maxDuration = flag.Duration("max_duration",
+		0,
+		"Maximum test runtime (including session setup). Once exceeded, the run is canceled like on SIGINT: all sessions quit, a partial report is written and throughput exits with code 4. 0 means no limit")
+
 	numSessions = flag.Int("sessions",
 		2,
 		"Number of sessions to use. The first one is used to receive messages, all others send")
 
+	mode = flag.String("mode",
+		"standalone",
+		`"standalone" runs all sessions in this process. "coordinator" distributes the sessions across agents (see -agents and -local_agents). "agent" runs sessions as instructed by a coordinator`)
+
+	agentAddrs = flag.String("agents",
+		"",
+		`Comma-separated list of -listen addresses (e.g. "10.0.0.2:8080,10.0.0.3:8080") of throughput processes started with -mode=agent. Only used with -mode=coordinator`)
+
+	localAgents = flag.Int("local_agents",
+		0,
+		"Number of agents to start as local child processes, in addition to -agents. Only used with -mode=coordinator")
+
+	rate = flag.Float64("rate",
+		10000,
+		"Number of messages/s to (try to) send, across all sessions (at most 1e6)")
+
 	numChannels = flag.Int("channels",
 		0,
 		"Number of channels to use. Defaults to -sessions / 50.")
 
-	messagesReceived uint64
-	messagesSent     uint64
+	drainTimeout = flag.Duration("drain_timeout",
+		5*time.Second,
+		"How long to wait for in-flight messages after sending stopped before considering them lost")
 
-	messageLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name:    "message_latency",
-		Help:    "Latency (in ms) between the point when the message was sent and when it was received",
-		Buckets: prometheus.ExponentialBuckets(1, 2, 15),
-	})
+	reconnect = flag.Bool("reconnect",
+		false,
+		"Whether to recreate sessions which failed (with exponential backoff) instead of continuing without them")
 
-	messagesSentMetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "messages_sent",
-		Help: "Number of PRIVMSGs sent",
-	})
+	maxReconnects = flag.Int("max_reconnects",
+		10,
+		"Maximum number of times a single session is recreated before it is considered dead. Only used with -reconnect")
 
-	messagesReceivedMetric = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: "messages_received",
-		Help: "Number of PRIVMSGs received",
-	})
+	maxDeadSessions = flag.Float64("max_dead_sessions",
+		0.1,
+		"Fraction of sending sessions which may die before the run fails. The receiving session dying always fails the run")
 
-	spreadMetric = prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "spread",
-		Help: "Spread between minimum/maximum number of messages/s within the last 10s",
-	})
+	setupTimeout = flag.Duration("setup_timeout",
+		5*time.Minute,
+		"How long to wait for all sessions to be registered and to have joined their channels before starting to send")
 
-	last10s = ring.New(10)
-)
+	churnRate = flag.Float64("churn_rate",
+		0,
+		"Fraction of sending sessions to delete (QUIT) and recreate per second while sending. 0 disables churn")
 
-func init() {
-	prometheus.MustRegister(messageLatency)
-	prometheus.MustRegister(messagesSentMetric)
-	prometheus.MustRegister(messagesReceivedMetric)
-	prometheus.MustRegister(spreadMetric)
-}
+	churnDelay = flag.Duration("churn_delay",
+		30*time.Second,
+		"How long to send without churn before starting to churn sessions, so that latency with and without churn can be compared")
 
-func getMin() uint64 {
-	var min uint64 = ^uint64(0) // max uint64 value
-	l := last10s
-	for i := 0; i < last10s.Len(); i++ {
-		l = l.Next()
-		if l.Value == nil {
-			continue
-		}
-		if l.Value.(uint64) < min {
-			min = l.Value.(uint64)
-		}
-	}
-	return min
-}
+	tui = flag.Bool("tui",
+		false,
+		"Show a live terminal dashboard (throughput and latency sparklines, latency percentiles, sessions, errors and convergence progress) on stdout instead of the per-second log lines. Log messages are shown below the dashboard, see also -tui_log")
 
-func getMax() uint64 {
-	var max uint64
-	l := last10s
-	for i := 0; i < last10s.Len(); i++ {
-		l = l.Next()
-		if l.Value == nil {
-			continue
-		}
-		if l.Value.(uint64) > max {
-			max = l.Value.(uint64)
-		}
-	}
-	return max
-}
+	tuiLog = flag.String("tui_log",
+		"",
+		"File to which log messages are appended while -tui is active, as only the most recent log messages are shown below the dashboard")
 
-func runWorker(tokens <-chan token, idx int) error {
-	log.Printf("initializing session %d", idx)
-	setupMessages := []string{
-		fmt.Sprintf("NICK bench-%d\r\n", idx),
-		"USER bench 0 * :bench\r\n",
-	}
-	if idx == 0 {
-		for j := 0; j < *numChannels; j++ {
-			setupMessages = append(setupMessages, fmt.Sprintf("JOIN #bench-%d\r\n", j))
-		}
-	} else {
-		setupMessages = append(setupMessages, fmt.Sprintf("JOIN #bench-%d\r\n", idx%*numChannels))
-	}
-	// TODO: wait for being registered, e.g. when the nick is already in use (previous benchmark still running)?
+	pushgateway = flag.String("pushgateway",
+		"",
+		"URL of a Prometheus Pushgateway (e.g. http://pushgateway:9091) to push the metrics of this process to, every -push_interval and at the end of the run. Metrics are grouped by job=throughput and run_id (see -run_id)")
 
-	// Defined in github.com/robustirc/robustirc/robusthttp, which is
-	// imported via github.com/robustirc/robustirc/util
-	tlsCAFile := flag.Lookup("tls_ca_file").Value.String()
-	session, err := robustsession.Create(*network, tlsCAFile)
-	if err != nil {
-		return fmt.Errorf("Could not create robustsession: %v", err)
-	}
-	for _, msg := range setupMessages {
-		log.Printf("-> %s\n", msg)
-		if err := session.PostMessage(msg); err != nil {
-			return err
-		}
-	}
+	remoteWrite = flag.String("remote_write",
+		"",
+		"URL of a Prometheus remote-write endpoint (e.g. http://prometheus:9090/api/v1/write) to write the metrics of this process to, every -push_interval and at the end of the run. All series are labelled with job=throughput and run_id (see -run_id)")
 
-	go func() {
-		for {
-			// Read a token to block this goroutine until we should
-			// send again. This throttles our sending speed.
-			<-tokens
-			if err := session.PostMessage(fmt.Sprintf("PRIVMSG #bench-%d :%d\r\n", idx%*numChannels, time.Now().UnixNano())); err != nil {
-				log.Printf("PostMessage error: %v", err)
-				return
-			}
-			atomic.AddUint64(&messagesSent, 1)
-		}
-	}()
+	pushInterval = flag.Duration("push_interval",
+		15*time.Second,
+		"How often to push metrics to -pushgateway and -remote_write. 0 only pushes at the end of the run")
 
-	for {
-		select {
-		case msg := <-session.Messages:
-			// Only parse each message once.
-			if idx != 0 {
-				continue
-			}
+	runIDFlag = flag.String("run_id",
+		"",
+		"Identifies this run in the report and as run_id label on all metrics. Defaults to the start time, e.g. 20200630-174500")
 
-			ircmsg := irc.ParseMessage(msg)
-			if ircmsg == nil {
-				continue
-			}
+	benchmarkRevision = flag.String("benchmark_revision",
+		"",
+		"git revision of github.com/robustirc/benchmark which this binary was built from, recorded in the report and as benchmark_revision label on all metrics")
 
-			atomic.AddUint64(&messagesReceived, 1)
+	robustircRevision = flag.String("robustirc_revision",
+		"",
+		"git revision of github.com/robustirc/robustirc under test, recorded in the report and as robustirc_revision label on all metrics")
 
-			if ircmsg.Command == irc.RPL_ENDOFNAMES {
-				log.Printf("session %d set up", idx)
-			}
+	labelsFlag = flag.String("labels",
+		"",
+		"Comma-separated name=value labels which are recorded in the report and attached to all metrics, e.g. team=irc,purpose=nightly. All metrics are also labelled with run_id and config_hash (a hash of the flags which influence the measurements and of -network_config_file)")
 
-			if ircmsg.Command != irc.PRIVMSG {
-				continue
-			}
+	slo = flag.String("slo",
+		"",
+		`SLO assertions which are evaluated at the end of the run, separated by semicolons, e.g. "p99_latency < 200ms; received_rate >= 2000; lost == 0". If any assertion fails, throughput exits with code 3. Available metrics: sent_rate, received_rate (mean msg/s), sent, received, lost, duplicated, reordered, loss_ratio, converged (0 or 1), baseline_regressions (see -baseline), leader_changes, leaderless_seconds and p50_latency, p90_latency, p99_latency, p99.9_latency (in ms, or a duration)`)
 
-			sent, err := strconv.ParseInt(ircmsg.Trailing(), 0, 64)
-			if err != nil {
-				continue
-			}
+	sloFile = flag.String("slo_file",
+		"",
+		"File containing additional SLO assertions (see -slo), one per line. Lines starting with # are ignored")
 
-			latency := time.Since(time.Unix(0, sent))
-			latencyMs := latency.Nanoseconds() / int64(time.Millisecond)
-			messageLatency.Observe(float64(latencyMs))
+	baseline = flag.String("baseline",
+		"",
+		"JSON report (see -report) of a previous run to compare this run to. Metrics which are worse than in the baseline by more than -baseline_tolerance are reported as regressions if the difference is statistically significant")
 
-		case err := <-session.Errors:
-			return err
-		}
-	}
+	baselineTolerance = flag.Float64("baseline_tolerance",
+		0.05,
+		"Relative change (0.05 = 5%) of a metric compared to -baseline which is not considered a regression")
+
+	baselineSignificance = flag.Float64("baseline_significance",
+		0.05,
+		"Significance level of the tests comparing this run to -baseline")
+
+	faults = flag.String("faults",
+		"",
+		`Schedule of faults to inject while sending, separated by semicolons, e.g. "5m kill leader; 10m restart 2". Each fault is <offset> <action> <target>, with action one of kill, start, restart, pause or resume and target one of leader, follower, a node number (1-based, in the order of -network) or an address of -network. Only supported with -mode=standalone`)
+
+	faultActuator = flag.String("fault_actuator",
+		"local",
+		`How faults are injected: "local" runs -fault_kill_command etc., "kubernetes" deletes the pods selected by -fault_kubernetes_selector (only kill is supported)`)
+
+	faultKillCommand = flag.String("fault_kill_command",
+		"",
+		`Shell command which kills a node, with -fault_actuator=local. {{.Node}} is replaced by the node number, {{.Addr}} by its address, e.g. "pkill -KILL -f 'robustirc -listen={{.Addr}}'"`)
+
+	faultStartCommand = flag.String("fault_start_command",
+		"",
+		"Shell command which starts a node which was killed, see -fault_kill_command")
+
+	faultPauseCommand = flag.String("fault_pause_command",
+		"",
+		"Shell command which makes a node unresponsive (e.g. by sending SIGSTOP or by partitioning it off the network), see -fault_kill_command")
+
+	faultResumeCommand = flag.String("fault_resume_command",
+		"",
+		"Shell command which reverts -fault_pause_command, see -fault_kill_command")
+
+	faultKubernetesNamespace = flag.String("fault_kubernetes_namespace",
+		"",
+		"Namespace of the pods of the RobustIRC nodes, with -fault_actuator=kubernetes. Defaults to the namespace throughput runs in (or \"default\" outside of a cluster)")
+
+	faultKubernetesSelector = flag.String("fault_kubernetes_selector",
+		"role=robustirc-node-{{.Node}}",
+		"Label selector of the pods of a node, with -fault_actuator=kubernetes. {{.Node}} is replaced by the node number")
+
+	statusInterval = flag.Duration("status_interval",
+		1*time.Second,
+		"How often to poll the status of all RobustIRC nodes during the run, to track raft states, leader changes and periods without leader. 0 disables polling")
+
+	faultRecoveryTimeout = flag.Duration("fault_recovery_timeout",
+		5*time.Minute,
+		"How long to wait for the received messages/s to drop below and recover to 90% of their rate before a fault before considering the network not recovered. Faults after which the rate stays at or above 90% for 10s without dropping are not waited for")
+
+	serverSelection = flag.String("server_selection",
+		"failover",
+		`Which of the -network servers each session sends its requests to: "failover" (the first healthy server, switching to the leader when a follower proxies a request, like robustsession), "round-robin" (session i prefers server i mod n), "random" (each session prefers a random server) or "pinned" (session i only ever uses server i mod n)`)
+
+	httpDialTimeout = flag.Duration("http_dial_timeout",
+		5*time.Second,
+		"Timeout for establishing connections to RobustIRC servers")
+
+	httpResponseHeaderTimeout = flag.Duration("http_response_header_timeout",
+		0,
+		"How long to wait for the response headers of a request to a RobustIRC server. 0 means no limit")
+
+	httpIdleConnTimeout = flag.Duration("http_idle_conn_timeout",
+		0,
+		"How long to keep idle connections to RobustIRC servers open. 0 means no limit")
+
+	httpMaxIdleConnsPerHost = flag.Int("http_max_idle_conns_per_host",
+		1,
+		"Maximum number of idle connections per RobustIRC server (per session, or in total with -http_shared_client)")
+
+	httpKeepAlive = flag.Bool("http_keepalive",
+		true,
+		"Whether to re-use connections for multiple requests (HTTP keep-alive)")
+
+	httpSharedClient = flag.Bool("http_shared_client",
+		false,
+		"Whether all sessions share one HTTP client (and hence one connection pool) instead of using one client per session, like robustsession does")
+
+	traceFile = flag.String("trace",
+		"",
+		"Path to a trace file (see cmd/irctrace) to replay instead of sending -rate messages/s. The test ends once the trace was replayed")
+
+	traceSpeed = flag.Float64("trace_speed",
+		1,
+		"Speed at which to replay -trace, e.g. 2 replays the trace twice as fast as it was recorded")
+
+	// runner is set up by main. In coordinator mode, it has no sessions
+	// and measures the sessions of all agents. A -network_config_sweep
+	// replaces it for each variant, see currentRunner.
+	runnerMu sync.Mutex
+	runner   *load.Runner
+
+	// faultSchedule is set up by main if -faults is specified.
+	faultSchedule *faultInjector
+)
+
+// currentRunner returns runner. Goroutines other than main must use it
+// instead of accessing runner directly.
+func currentRunner() *load.Runner {
+	runnerMu.Lock()
+	defer runnerMu.Unlock()
+	return runner
 }
 
-func waitForHealthy(servers []string) error {
-	log.Printf("Waiting for RobustIRC network to become healthy")
-	started := time.Now()
-	for {
-		statuses, err := util.EnsureNetworkHealthy(servers, "k8s")
-		if err == nil {
-			return nil
-		}
-		log.Printf("network health: %v, statuses = %+v", err, statuses)
-		if timeout := 1 * time.Minute; time.Since(started) > timeout {
-			return fmt.Errorf("RobustIRC network did not become healthy within %v (error: %v)", timeout, err)
-		}
-		// Intentionally without exponential backoff. The RobustIRC
-		// instance in question is only hit by this single throughput
-		// process, so it can take 1 retry/second.
-		time.Sleep(1 * time.Second)
-	}
+// setRunner replaces runner with r.
+func setRunner(r *load.Runner) {
+	runnerMu.Lock()
+	defer runnerMu.Unlock()
+	runner = r
 }
 
 func waitForPrometheusHealthy(addr string) error {
@@ -252,20 +331,6 @@ func waitForPrometheusHealthy(addr string) error {
 	}
 }
 
-func setNetworkConfigFrom(servers []string, filename string) error {
-	config, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return err
-	}
-	log.Printf("Setting RobustIRC network configuration from %q", filename)
-	// One try is sufficient: conflicts in network config setting can only
-	// happen when something else/someone else is modifying the network config
-	// at the same time. Since the RobustIRC network in question is dedicated
-	// to the loadtest, we are the only modifier of configs — and if we
-	// unexpectedly aren’t, failing loudly is a good thing.
-	return util.SetNetworkConfig(servers, string(config), os.Getenv("ROBUSTIRC_NETWORK_PASSWORD"))
-}
-
 // snapshotMetrics queries prometheus and returns the URL of a
 // snapshot of the RobustIRC grafana dashboard stored on
 // snapshot.raintank.io.
@@ -326,65 +391,110 @@ func snapshotMetrics(prometheusAddr, filename string) (string, error) {
 	return snapshotResp.Url, nil
 }
 
-func runThroughputTest() error {
-	log.Printf("Joining %d channels with %d connections\n", *numChannels, *numSessions)
+// runnerOptions returns the options for running the sessions
+// [first, first+count) according to the flags.
+func runnerOptions(first, count int) (load.Options, error) {
+	if err := setupHTTPClient(); err != nil {
+		return load.Options{}, err
+	}
+	buckets, nativeFactor, err := parseBuckets(*latencyBuckets)
+	if err != nil {
+		return load.Options{}, err
+	}
+	return load.Options{
+		Servers:                     strings.Split(*network, ","),
+		Sessions:                    *numSessions,
+		First:                       first,
+		Count:                       count,
+		Channels:                    *numChannels,
+		Rate:                        *rate,
+		UntilConverged:              true,
+		MinDuration:                 *minDuration,
+		DrainTimeout:                *drainTimeout,
+		SetupTimeout:                *setupTimeout,
+		Reconnect:                   *reconnect,
+		MaxReconnects:               *maxReconnects,
+		MaxDeadSessions:             *maxDeadSessions,
+		ChurnRate:                   *churnRate,
+		ChurnDelay:                  *churnDelay,
+		ServerSelection:             *serverSelection,
+		Transport:                   transportOptions(),
+		SharedClient:                *httpSharedClient,
+		LatencyBuckets:              buckets,
+		NativeHistogramBucketFactor: nativeFactor,
+		ClockOffset:                 time.Duration(atomic.LoadInt64(&clockOffset)),
+
+		SessionCreated:     runReport.addSessionServed,
+		SetupFinished:      runReport.setSetupDuration,
+		SecondRecorded:     recordSecond,
+		ConvergenceChecked: runReport.setConvergence,
+		Hold: func() bool {
+			return !faultSchedule.done()
+		},
+	}, nil
+}
 
-	tokens := make(chan token)
-	for i := 0; i < *numSessions; i++ {
-		go runWorker(tokens, i)
+// recordSecond logs and reports the measurement of a second.
+func recordSecond(s load.Second, min, max uint64) {
+	if liveDashboard == nil {
+		log.Printf("sent %d, recv %d, (last 10s) min = %d, max = %d, spread = %d", s.Sent, s.Received, min, max, max-min)
 	}
-	started := time.Now()
-	// tokensTicker is a ticker which unblocks goroutines (“supplies a
-	// token” in the typical token bucket terminology used in network
-	// throttling) often enough that they can send 10000 queries/s
-	// (calculated with microsecond precision).
-	tokensTicker := time.Tick(time.Duration(1e6/10000) * time.Microsecond)
-	every1s := time.Tick(1 * time.Second)
-	every10s := time.Tick(10 * time.Second)
-	currentMeasurement := last10s
-	var lastSent uint64
-	var lastReceived uint64
-	for {
-		select {
-		case <-every1s:
-			sent := atomic.LoadUint64(&messagesSent)
-			received := atomic.LoadUint64(&messagesReceived)
-			currentMeasurement = currentMeasurement.Next()
-			currentMeasurement.Value = received - lastReceived
-			min := getMin()
-			max := getMax()
-			spread := max - min
-			log.Printf("sent %d, recv %d, (last 10s) min = %d, max = %d, spread = %d", sent-lastSent, received-lastReceived, min, max, spread)
-
-			messagesSentMetric.Add(float64(sent - lastSent))
-			messagesReceivedMetric.Add(float64(received - lastReceived))
-			spreadMetric.Set(float64(spread))
-
-			lastSent = sent
-			lastReceived = received
-
-		case <-every10s:
-			if time.Since(started) <= *minDuration {
-				continue
-			}
-			min := getMin()
-			max := getMax()
-			spread := max - min
+	runReport.addSample(s)
+	if liveDashboard != nil {
+		liveDashboard.update(s, min, max)
+	}
+	faultSchedule.observe(s.Received)
+}
 
-			if float32(spread)/float32(max) < 0.1 {
-				log.Printf("converged! spread is < 10%%")
-				return nil
-			}
+// newStandaloneRunner returns a Runner for all sessions, which replays
+// -trace if specified. prefix overrides load.Options.Prefix unless
+// empty.
+func newStandaloneRunner(prefix string) (*load.Runner, error) {
+	opts, err := runnerOptions(0, *numSessions)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		opts.Prefix = prefix
+	}
+	if *traceFile != "" {
+		if opts.Trace, err = trace.ReadFile(*traceFile); err != nil {
+			return nil, err
+		}
+		opts.TraceSpeed = *traceSpeed
+		log.Printf("Read %d events from %s", len(opts.Trace), *traceFile)
+	}
+	return load.New(opts)
+}
 
-			// This approach does not work well: it just permanently reduces the qps, without any clear improvement in spread
-			// targetQps := (1 - (spread / max)) * max
-			// log.Printf("re-adjusting: targetQps = %v", targetQps)
-			// tokensTicker = time.Tick(time.Duration(1e6/targetQps) * time.Microsecond)
+// logResults logs the end-of-run results. In-flight messages must
+// have been drained.
+func logResults() {
+	runner.LogResults()
+	logLatencyReport(runner.Latency())
+	faultSchedule.logReport()
+}
 
-		case <-tokensTicker:
-			tokens <- token{}
-		}
+// runThroughputTest runs the benchmark until the throughput converged
+// or ctx is done, in which case the results so far are logged and
+// ctx.Err() is returned. All sessions quit before it returns.
+func runThroughputTest(ctx context.Context) error {
+	defer quitSessions(runner)
+	if err := runner.Setup(ctx); err != nil {
+		return err
+	}
+	if faultSchedule != nil {
+		// Stops injecting faults once the run is over.
+		faultCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		faultSchedule.start(faultCtx, time.Now())
 	}
+	err := runner.Run(ctx)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	logResults()
+	return err
 }
 
 const (
@@ -396,7 +506,87 @@ func main() {
 	flag.Parse()
 
 	if *numSessions < 2 {
-		log.Fatal("-sessions needs to be 2 or higher (specified %d)", *numSessions)
+		log.Fatalf("-sessions needs to be 2 or higher (specified %d)", *numSessions)
+	}
+	if err := load.CheckRate(*rate); err != nil {
+		log.Fatalf("-rate: %v", err)
+	}
+
+	if *traceFile != "" && *mode != "standalone" {
+		log.Fatalf("-trace is only supported with -mode=standalone")
+	}
+	if *faults != "" && *mode != "standalone" {
+		log.Fatalf("-faults is only supported with -mode=standalone")
+	}
+	faultEntries, err := parseFaultSchedule(*faults)
+	if err != nil {
+		log.Fatalf("-faults: %v", err)
+	}
+	labels, err := parseLabels(*labelsFlag)
+	if err != nil {
+		log.Fatalf("-labels: %v", err)
+	}
+	slos, err := readSLOs(*slo, *sloFile)
+	if err != nil {
+		log.Fatalf("-slo: %v", err)
+	}
+	if *baseline != "" {
+		if baselineReport, err = loadBaseline(*baseline); err != nil {
+			log.Fatalf("-baseline: %v", err)
+		}
+	}
+	switch *serverSelection {
+	case "failover", "round-robin", "random", "pinned":
+	default:
+		log.Fatalf("Unknown -server_selection=%q, expected failover, round-robin, random or pinned", *serverSelection)
+	}
+	switch *healthCheck {
+	case "none", "status", "roundtrip":
+	default:
+		log.Fatalf("Unknown -health_check=%q, expected status, roundtrip or none", *healthCheck)
+	}
+	if *traceSpeed <= 0 {
+		log.Fatalf("-trace_speed needs to be positive (specified %v)", *traceSpeed)
+	}
+
+	if _, _, err := parseBuckets(*latencyBuckets); err != nil {
+		log.Fatalf("-latency_buckets: %v", err)
+	}
+	var (
+		networkConfig string
+		sweepVariants []configVariant
+	)
+	if *networkConfigSweep != "" {
+		if *networkConfigFile == "" {
+			log.Fatalf("-network_config_sweep requires -network_config_file")
+		}
+		if *mode != "standalone" {
+			log.Fatalf("-network_config_sweep is only supported with -mode=standalone")
+		}
+		if *faults != "" {
+			log.Fatalf("-network_config_sweep cannot be combined with -faults")
+		}
+		// SLOs and the baseline comparison are evaluated for the whole
+		// report, which would mix the variants.
+		if *slo != "" || *sloFile != "" {
+			log.Fatalf("-network_config_sweep cannot be combined with -slo or -slo_file")
+		}
+		if *baseline != "" {
+			log.Fatalf("-network_config_sweep cannot be combined with -baseline")
+		}
+		// The report records the template, each variant its config.
+		networkConfig, sweepVariants, err = readConfigSweep(*networkConfigFile, *networkConfigParams, *networkConfigSweep)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if *networkConfigFile != "" {
+		if networkConfig, err = readNetworkConfig(*networkConfigFile, *networkConfigParams); err != nil {
+			log.Fatalf("-network_config_file: %v", err)
+		}
+	}
+
+	if *mode == "agent" {
+		log.Fatal(runAgent())
 	}
 
 	if *numChannels == 0 {
@@ -412,23 +602,123 @@ func main() {
 		log.Fatal(err)
 	}
 
-	if *networkConfigFile != "" {
-		if err := setNetworkConfigFrom(servers, *networkConfigFile); err != nil {
-			log.Fatal(err)
+	defer runExitHooks()
+	configurator := &networkConfigurator{servers: servers}
+	onExit(func() {
+		if err := configurator.restore(); err != nil {
+			log.Print(err)
+		}
+	})
+	// A -network_config_sweep applies the config of each variant.
+	if *networkConfigFile != "" && len(sweepVariants) == 0 {
+		log.Printf("Setting RobustIRC network configuration from %q", *networkConfigFile)
+		if err := configurator.apply(networkConfig); err != nil {
+			fatal(err)
+		}
+	}
+	runReport.start(networkConfig)
+	setupIdentity(labels)
+	log.Printf("Run %s (config hash %s)", identity.RunID, identity.ConfigHash)
+
+	if *tui {
+		liveDashboard, err = newDashboard(os.Stdout, *tuiLog)
+		if err != nil {
+			fatalf("-tui_log: %v", err)
 		}
 	}
 
+	// The clock offset is passed to the Runner.
+	if *clockReference != "" {
+		if err := synchronizeClock(*clockReference); err != nil {
+			fatal(err)
+		}
+	}
+
+	var (
+		agents []string
+		r      *load.Runner
+	)
+	switch *mode {
+	case "standalone":
+		var prefix string
+		if len(sweepVariants) > 0 {
+			prefix = sweepPrefix(0)
+		}
+		r, err = newStandaloneRunner(prefix)
+
+	case "coordinator":
+		if *listen == "" {
+			fatal("-mode=coordinator requires -listen, which agents use as clock reference")
+		}
+		if *agentAddrs != "" {
+			agents = strings.Split(*agentAddrs, ",")
+		}
+		if *localAgents > 0 {
+			local, cmds, err := startLocalAgents(*localAgents)
+			// The hook also runs when exiting via fatal, so that no
+			// agent processes are left behind.
+			onExit(func() { stopLocalAgents(local, cmds) })
+			if err != nil {
+				fatal(err)
+			}
+			agents = append(agents, local...)
+		}
+		if len(agents) == 0 {
+			fatal("-mode=coordinator requires -agents or -local_agents")
+		}
+		r, err = newCoordinatorRunner(agents)
+
+	default:
+		fatalf("Unknown -mode=%q, expected standalone, coordinator or agent", *mode)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	setRunner(r)
+	gatherer := prometheus.Gatherers{
+		prometheus.DefaultGatherer,
+		prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return currentRunner().Registry().Gather()
+		}),
+	}
+
+	metricsPush := newMetricsPusher(gatherer, identity.constLabels())
+	if metricsPush != nil && *pushInterval > 0 {
+		go metricsPush.run(*pushInterval)
+	}
+
+	if *faults != "" {
+		a, err := newActuator()
+		if err != nil {
+			fatal(err)
+		}
+		faultSchedule = newFaultInjector(faultEntries, servers, a)
+	}
+
+	if *statusInterval > 0 {
+		nodeStatus = newStatusTracker(servers)
+		go nodeStatus.poll(*statusInterval)
+	}
+
 	if *prometheusAddr != "" {
 		if err := waitForPrometheusHealthy(*prometheusAddr); err != nil {
-			log.Fatal(err)
+			fatal(err)
 		}
 	}
 
 	if *listen != "" {
 		go func() {
 			log.Printf("Listening on %q", *listen)
-			http.Handle("/metrics", promhttp.Handler())
-			log.Fatal(http.ListenAndServe(*listen, nil))
+			http.Handle("/metrics", promhttp.InstrumentMetricHandler(
+				prometheus.DefaultRegisterer,
+				promhttp.HandlerFor(
+					labelledGatherer{gatherer, identity.constLabels()},
+					promhttp.HandlerOpts{})))
+			http.HandleFunc("/report.json", runReport.serveJSON)
+			http.HandleFunc("/report.md", runReport.serveMarkdown)
+			http.HandleFunc("/time", serveTime)
+			registerControlHandlers(http.DefaultServeMux, &controller{currentRunner}, *controlAPI)
+			fatal(http.ListenAndServe(*listen, nil))
 		}()
 	}
 
@@ -437,20 +727,71 @@ func main() {
 		runtime.GOMAXPROCS(runtime.NumCPU())
 	}
 
-	if err := runThroughputTest(); err != nil {
-		log.Fatal(err)
+	ctx, cancel := runContext()
+	defer cancel()
+	switch {
+	case len(sweepVariants) > 0:
+		err = runSweep(ctx, configurator, sweepVariants)
+	case *mode == "standalone":
+		err = runThroughputTest(ctx)
+	default:
+		err = runCoordinator(ctx, agents)
+	}
+	canceled := cancellation.reason(ctx)
+	if err != nil && canceled == "" {
+		fatal(err)
+	}
+	// Restore the network config right away instead of after -linger;
+	// the exit hook only covers runs which end early.
+	if err := configurator.restore(); err != nil {
+		log.Print(err)
+	}
+	if canceled != "" {
+		log.Printf("Run canceled (%s), reporting partial results", canceled)
+		runReport.setCanceled(canceled)
 	}
 
-	if *snapshotDashboards != "" && *prometheusAddr != "" {
+	if *snapshotDashboards != "" && *prometheusAddr != "" && canceled == "" {
 		log.Printf("Giving Prometheus another %v (scrape_interval)", prometheusScrapeInterval)
 		time.Sleep(prometheusScrapeInterval)
 
 		for _, filename := range strings.Split(*snapshotDashboards, ",") {
 			snapshotUrl, err := snapshotMetrics(*prometheusAddr, filename)
 			if err != nil {
-				log.Fatal(err)
+				fatal(err)
 			}
 			log.Printf("RobustIRC dashboard snapshot stored at %s", snapshotUrl)
+			runReport.addSnapshot(snapshotUrl)
 		}
 	}
+
+	if liveDashboard != nil {
+		liveDashboard.stop()
+	}
+	runReport.finish()
+	if c := runReport.comparison(); c != nil {
+		c.logReport()
+	}
+	slosPassed := runReport.checkSLOs(slos)
+	if metricsPush != nil {
+		metricsPush.push()
+	}
+	if *reportPrefix != "" {
+		if err := runReport.writeFiles(*reportPrefix); err != nil {
+			fatal(err)
+		}
+	}
+
+	if *listen != "" && *linger > 0 && canceled == "" {
+		log.Printf("Run finished, serving %q for another %v", *listen, *linger)
+		time.Sleep(*linger)
+	}
+
+	if canceled != "" {
+		exit(canceledExitCode)
+	}
+	if !slosPassed {
+		log.Printf("SLO assertions failed, exiting with code %d", sloFailedExitCode)
+		exit(sloFailedExitCode)
+	}
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+)
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in -short mode")
+	}
+
+	n := fakerobustirc.NewNetwork(3, fakerobustirc.Options{
+		LossRate: 0.01,
+	})
+	defer n.Close()
+
+	tempdir, err := ioutil.TempDir("", "throughput-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempdir)
+	caFile, err := n.WriteCAFile(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"network":       n.Addr(),
+		"tls_ca_file":   caFile,
+		"sessions":      "5",
+		"channels":      "1",
+		"rate":          "500",
+		"min_duration":  "0",
+		"drain_timeout": "1s",
+		"setup_timeout": "30s",
+		"health_check":  "roundtrip",
+	} {
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("flag.Set(%q, %q): %v", name, value, err)
+		}
+	}
+	if err := waitForHealthy(strings.Split(*network, ",")); err != nil {
+		t.Fatal(err)
+	}
+	runner, err = newStandaloneRunner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runThroughputTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	total := runner.AccountingTotal()
+	if total.Received == 0 {
+		t.Fatalf("no messages received: %+v", total)
+	}
+	_, _, dropped := n.Stats()
+	if got, want := total.Lost, dropped; got != want {
+		t.Errorf("lost messages: got %d, want %d (dropped by the network)", got, want)
+	}
+	if got, want := runner.Latency().Count(), total.Received+total.Duplicated; got != want {
+		t.Errorf("latency samples: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robustirc/benchmark/load"
+)
+
+const (
+	// dashboardHistory is the number of seconds shown in sparklines.
+	dashboardHistory = 60
+
+	// dashboardLogLines is the number of log lines shown below the
+	// dashboard.
+	dashboardLogLines = 10
+)
+
+// sparkBlocks are the characters of a sparkline, from low to high.
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// liveDashboard is set up by main if -tui is specified.
+var liveDashboard *dashboard
+
+// dashboard renders a live terminal dashboard from the per-second
+// measurements of package load (see recordSecond). While it is
+// running, log messages are shown below the dashboard instead of being
+// written to stderr.
+type dashboard struct {
+	out     io.Writer
+	logFile *os.File
+
+	mu      sync.Mutex
+	started time.Time // when sending started, zero before
+	history []load.Second
+	min     uint64
+	max     uint64
+	logs    []string
+	partial []byte // incomplete log line
+}
+
+// newDashboard starts drawing a dashboard to out. Log messages are
+// additionally appended to logFilename, unless it is empty.
+func newDashboard(out io.Writer, logFilename string) (*dashboard, error) {
+	d := &dashboard{out: out}
+	if logFilename != "" {
+		f, err := os.OpenFile(logFilename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		d.logFile = f
+	}
+	log.SetOutput(d)
+	return d, nil
+}
+
+// stop restores logging to stderr. The last frame stays on screen.
+func (d *dashboard) stop() {
+	log.SetOutput(os.Stderr)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.logFile != nil {
+		d.logFile.Close()
+	}
+}
+
+// Write implements io.Writer for the log package. The dashboard is
+// redrawn for every log message, so that the message of log.Fatal is
+// visible before the process exits.
+func (d *dashboard) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.logFile != nil {
+		d.logFile.Write(p)
+	}
+	d.partial = append(d.partial, p...)
+	for {
+		idx := bytes.IndexByte(d.partial, '\n')
+		if idx == -1 {
+			break
+		}
+		// Logged IRC messages end in \r\n.
+		if line := strings.TrimRight(string(d.partial[:idx]), "\r"); line != "" {
+			d.logs = append(d.logs, line)
+		}
+		d.partial = d.partial[idx+1:]
+	}
+	if len(d.logs) > dashboardLogLines {
+		d.logs = d.logs[len(d.logs)-dashboardLogLines:]
+	}
+	d.drawLocked()
+	return len(p), nil
+}
+
+// update is called by recordSecond once per second.
+func (d *dashboard) update(sample load.Second, min, max uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.started.IsZero() {
+		d.started = sample.Time.Add(-1 * time.Second)
+	}
+	d.history = append(d.history, sample)
+	if len(d.history) > dashboardHistory {
+		d.history = d.history[len(d.history)-dashboardHistory:]
+	}
+	d.min, d.max = min, max
+	d.drawLocked()
+}
+
+// sparkline renders values scaled to the highest value.
+func sparkline(values []float64) string {
+	var max float64
+	for _, v := range values {
+		if v > max {
+			max = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range values {
+		idx := 0
+		if max > 0 {
+			idx = int(v / max * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[idx])
+	}
+	return b.String()
+}
+
+// progressBar renders fraction (0 to 1) as a bar of width characters.
+func progressBar(fraction float64, width int) string {
+	if fraction > 1 {
+		fraction = 1
+	}
+	filled := int(fraction * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat("-", width-filled) + "]"
+}
+
+func (d *dashboard) drawLocked() {
+	var buf bytes.Buffer
+	// Move the cursor to the top left and clear the screen.
+	buf.WriteString("\x1b[H\x1b[2J")
+
+	var elapsed time.Duration
+	if d.started.IsZero() {
+		fmt.Fprintf(&buf, "throughput — run %s — setting up sessions\n\n", identity.RunID)
+	} else {
+		elapsed = time.Since(d.started).Round(time.Second)
+		fmt.Fprintf(&buf, "throughput — run %s — sending for %v\n\n", identity.RunID, elapsed)
+	}
+
+	sent := make([]float64, len(d.history))
+	received := make([]float64, len(d.history))
+	p99 := make([]float64, len(d.history))
+	for idx, s := range d.history {
+		sent[idx] = float64(s.Sent)
+		received[idx] = float64(s.Received)
+		p99[idx] = s.LatencyP99
+	}
+	var last load.Second
+	if n := len(d.history); n > 0 {
+		last = d.history[n-1]
+	}
+	fmt.Fprintf(&buf, "sent      %6d msg/s  %s\n", last.Sent, sparkline(sent))
+	fmt.Fprintf(&buf, "received  %6d msg/s  %s\n", last.Received, sparkline(received))
+	fmt.Fprintf(&buf, "p99       %6.1f ms     %s\n\n", last.LatencyP99, sparkline(p99))
+
+	if runner := currentRunner(); runner != nil {
+		latency := runner.Latency()
+		quantiles := make([]string, len(reportQuantiles))
+		for idx, q := range reportQuantiles {
+			quantiles[idx] = fmt.Sprintf("%s %v", quantileName(q), latency.Quantile(q).Round(10*time.Microsecond))
+		}
+		fmt.Fprintf(&buf, "latency   %s (%d messages)\n", strings.Join(quantiles, ", "), latency.Count())
+		stats := runner.Stats()
+		fmt.Fprintf(&buf, "sessions  %d active, %d session errors, %d request errors\n",
+			stats.SessionsActive, stats.SessionErrors, stats.RequestErrors)
+	}
+
+	convergence := "waiting for measurements"
+	if d.max > 0 {
+		ratio := float64(d.max-d.min) / float64(d.max)
+		// The run converges once the spread is below 10% of max.
+		convergence = fmt.Sprintf("%s spread %d msg/s (%.1f%% of max, target < 10%%)",
+			progressBar(0.1/ratio, 20), d.max-d.min, ratio*100)
+	}
+	fmt.Fprintf(&buf, "converge  %s\n", convergence)
+	if *minDuration > 0 && !d.started.IsZero() {
+		fmt.Fprintf(&buf, "duration  %s %v of %v\n",
+			progressBar(float64(elapsed)/float64(*minDuration), 20), elapsed, *minDuration)
+	}
+
+	buf.WriteString("\n")
+	for _, line := range d.logs {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	d.out.Write(buf.Bytes())
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSparkline(t *testing.T) {
+	if got, want := sparkline([]float64{0, 1, 2, 3, 4, 5, 6, 7}), "▁▂▃▄▅▆▇█"; got != want {
+		t.Errorf("sparkline: got %q, want %q", got, want)
+	}
+	if got, want := sparkline([]float64{0, 0}), "▁▁"; got != want {
+		t.Errorf("sparkline of zeros: got %q, want %q", got, want)
+	}
+	if got, want := progressBar(0.5, 4), "[##--]"; got != want {
+		t.Errorf("progressBar: got %q, want %q", got, want)
+	}
+	if got, want := progressBar(3, 4), "[####]"; got != want {
+		t.Errorf("progressBar beyond 1: got %q, want %q", got, want)
+	}
+}
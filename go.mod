@@ -1,34 +1,60 @@
 module github.com/robustirc/benchmark
 
-go 1.14
+go 1.17
 
 require (
+	github.com/golang/snappy v0.0.4
+	github.com/prometheus/client_golang v1.14.0
+	github.com/prometheus/client_model v0.3.0
+	github.com/prometheus/common v0.37.0
+	github.com/robustirc/robustirc v0.0.0-20170330175148-1c3821e0c1e7
+	github.com/stapelberg/loggedexec v0.0.0-20160810193442-ee51d868da94
+	golang.org/x/net v0.0.0-20220225172249-27dd8689420f
+	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f
+	gopkg.in/sorcix/irc.v2 v2.0.0-20190306112350-8d7a73540b90
+	k8s.io/api v0.15.12
+	k8s.io/apimachinery v0.15.12
+	k8s.io/client-go v0.15.12
+)
+
+require (
+	cloud.google.com/go v0.65.0 // indirect
 	github.com/Debian/mergebot v0.0.0-20160807175040-f79670e3e967 // indirect
 	github.com/armon/go-metrics v0.0.0-20170601214432-f036747b9d0e // indirect
-	github.com/google/btree v1.0.0 // indirect
-	github.com/gregjones/httpcache v0.0.0-20190611155906-901d90724c79 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/gogo/protobuf v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	github.com/google/gofuzz v1.0.0 // indirect
+	github.com/googleapis/gnostic v0.0.0-20170729233727-0c5108395e2d // indirect
 	github.com/hashicorp/go-msgpack v0.0.0-20150518234257-fa3f63826f7c // indirect
 	github.com/hashicorp/raft v0.0.0-20170710173458-b3d48f1a4e56 // indirect
+	github.com/imdario/mergo v0.3.5 // indirect
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/niemeyer/pretty v0.0.0-20200227124842-a10e7caefd8e // indirect
-	github.com/peterbourgon/diskv v2.0.1+incompatible // indirect
-	github.com/prometheus/client_golang v1.7.1
-	github.com/prometheus/common v0.10.0
-	github.com/robustirc/bridge v1.7.1
+	github.com/prometheus/procfs v0.8.0 // indirect
+	github.com/robustirc/bridge v1.7.1 // indirect
 	github.com/robustirc/rafthttp v0.0.0-20160522203950-0785f8c77b66 // indirect
-	github.com/robustirc/robustirc v0.0.0-20170330175148-1c3821e0c1e7
 	github.com/sorcix/irc v1.1.4 // indirect
-	github.com/stapelberg/loggedexec v0.0.0-20160810193442-ee51d868da94
+	github.com/spf13/pflag v1.0.1 // indirect
 	github.com/stretchr/testify v1.6.1 // indirect
-	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
-	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9 // indirect
+	golang.org/x/oauth2 v0.0.0-20220223155221-ee480838109b // indirect
+	golang.org/x/sys v0.0.0-20220520151302-bc2c85ada10a // indirect
+	golang.org/x/text v0.3.7 // indirect
 	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e // indirect
+	google.golang.org/appengine v1.6.6 // indirect
+	google.golang.org/protobuf v1.28.1 // indirect
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
-	gopkg.in/sorcix/irc.v2 v2.0.0-20190306112350-8d7a73540b90
+	gopkg.in/inf.v0 v0.9.0 // indirect
 	gopkg.in/vmihailenco/msgpack.v2 v2.9.1 // indirect
-	gopkg.in/yaml.v1 v1.0.0-20140924161607-9f9df34309c0 // indirect
-	k8s.io/api v0.15.12
-	k8s.io/apimachinery v0.15.12
-	k8s.io/client-go v0.15.12
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	k8s.io/klog v0.3.1 // indirect
+	k8s.io/utils v0.0.0-20190221042446-c2654d5206da // indirect
 	labix.org/v2/mgo v0.0.0-20140701140051-000000000287 // indirect
-	launchpad.net/gocheck v0.0.0-20140225173054-000000000087 // indirect
+	sigs.k8s.io/yaml v1.1.0 // indirect
 )
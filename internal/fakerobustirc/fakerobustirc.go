@@ -0,0 +1,676 @@
+// Package fakerobustirc implements an in-process fake RobustIRC network,
+// which is sufficient to run the throughput benchmark against: it
+// implements the session endpoints used by
+// github.com/robustirc/bridge/robustsession, the status endpoint used
+// by util.EnsureNetworkHealthy and the config endpoints used by
+// util.SetNetworkConfig.
+//
+// There is no Raft: all nodes of the network share the same state, and
+// the leader is the running node with the lowest index (see StopNode for
+// simulating crashes and leader elections). The IRC server only
+// understands what the benchmark needs (NICK, USER, JOIN, PRIVMSG,
+// NOTICE, QUIT).
+package fakerobustirc
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Message types, see robustsession.
+const (
+	typeIRCToClient = 3
+	typePing        = 4
+)
+
+type robustId struct {
+	Id    int64
+	Reply int64
+}
+
+func (i robustId) String() string {
+	return fmt.Sprintf("%d.%d", i.Id, i.Reply)
+}
+
+type robustMessage struct {
+	Id      robustId
+	Session robustId
+	Type    int64
+	Data    string
+	Servers []string `json:",omitempty"`
+}
+
+// Options configure fault injection. The zero value is a well-behaved
+// network.
+type Options struct {
+	// Latency is added to each PostMessage request.
+	Latency time.Duration
+
+	// LossRate is the fraction of PRIVMSGs which are accepted, but not
+	// delivered.
+	LossRate float64
+
+	// ErrorRate is the fraction of PostMessage requests which are
+	// answered with a (temporary) HTTP 500 error.
+	ErrorRate float64
+
+	// ElectionTimeout is how long the network is without leader after
+	// the leader was stopped, see StopNode.
+	ElectionTimeout time.Duration
+}
+
+type session struct {
+	id       robustId
+	auth     string
+	nick     string
+	user     bool
+	welcomed bool
+	channels map[string]bool
+
+	// messages is the output stream of the session. Message ids are
+	// strictly increasing.
+	messages []robustMessage
+	deleted  bool
+}
+
+// Network is a fake RobustIRC network, consisting of one or more nodes.
+type Network struct {
+	opts Options
+
+	nodes   []*httptest.Server
+	servers []string
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	rand     *rand.Rand
+	lastId   int64
+	sessions map[int64]*session
+	nicks    map[string]*session
+	channels map[string]map[*session]bool
+
+	config         string
+	configRevision uint64
+
+	// down contains the nodes which were stopped, see StopNode.
+	down []bool
+	// leader is the index of the leader node, or -1 while there is none.
+	leader   int
+	electing bool
+
+	// stats
+	posted    uint64
+	delivered uint64
+	dropped   uint64
+}
+
+// NewNetwork starts a fake RobustIRC network with the specified number
+// of nodes. Close must be called to stop it.
+func NewNetwork(nodes int, opts Options) *Network {
+	n := &Network{
+		opts:     opts,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		sessions: make(map[int64]*session),
+		nicks:    make(map[string]*session),
+		channels: make(map[string]map[*session]bool),
+		down:     make([]bool, nodes),
+	}
+	n.cond = sync.NewCond(&n.mu)
+	for i := 0; i < nodes; i++ {
+		idx := i
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n.serveHTTP(idx, w, r)
+		}))
+		n.nodes = append(n.nodes, srv)
+		n.servers = append(n.servers, strings.TrimPrefix(srv.URL, "https://"))
+	}
+	return n
+}
+
+// Close stops all nodes.
+func (n *Network) Close() {
+	n.mu.Lock()
+	for _, s := range n.sessions {
+		s.deleted = true
+	}
+	n.cond.Broadcast()
+	n.mu.Unlock()
+	for _, srv := range n.nodes {
+		srv.CloseClientConnections()
+		srv.Close()
+	}
+}
+
+// StopNode simulates a crash of the specified node: all requests to it
+// fail until StartNode is called. If the node was the leader, the
+// network is without leader for Options.ElectionTimeout, after which
+// the running node with the lowest index becomes leader.
+func (n *Network) StopNode(node int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[node] = true
+	if n.leader == node {
+		n.leader = -1
+		n.electLocked()
+	}
+	n.cond.Broadcast()
+}
+
+// StartNode brings a node which was stopped back up.
+func (n *Network) StartNode(node int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.down[node] = false
+	if n.leader == -1 {
+		n.electLocked()
+	}
+}
+
+func (n *Network) electLocked() {
+	if n.electing {
+		return
+	}
+	n.electing = true
+	time.AfterFunc(n.opts.ElectionTimeout, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.electing = false
+		for node, down := range n.down {
+			if !down {
+				n.leader = node
+				return
+			}
+		}
+	})
+}
+
+// KillSession deletes the session using nick, as if it expired: all
+// further requests of the session fail with HTTP 404. It returns
+// whether such a session existed.
+func (n *Network) KillSession(nick string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s, ok := n.nicks[strings.ToLower(nick)]
+	if !ok {
+		return false
+	}
+	n.quitLocked(s, "Killed")
+	return true
+}
+
+// Leader returns the address of the current leader, or empty if there
+// is none.
+func (n *Network) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leaderLocked()
+}
+
+func (n *Network) leaderLocked() string {
+	if n.leader == -1 {
+		return ""
+	}
+	return n.servers[n.leader]
+}
+
+// Servers returns the host:port addresses of all nodes.
+func (n *Network) Servers() []string {
+	return append([]string(nil), n.servers...)
+}
+
+// Addr returns the comma-separated list of all node addresses, as
+// expected by -network.
+func (n *Network) Addr() string {
+	return strings.Join(n.servers, ",")
+}
+
+// WriteCAFile writes the certificate of the network (which is shared by
+// all nodes) to a PEM file in dir and returns its path, for use with
+// -tls_ca_file.
+func (n *Network) WriteCAFile(dir string) (string, error) {
+	cert := n.nodes[0].Certificate()
+	if cert == nil {
+		return "", fmt.Errorf("node 0 has no certificate")
+	}
+	path := dir + "/fakerobustirc.pem"
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return path, ioutil.WriteFile(path, b, 0644)
+}
+
+// CertPool returns a pool containing the certificate of the network.
+func (n *Network) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(n.nodes[0].Certificate())
+	return pool
+}
+
+// Stats returns the number of PRIVMSGs posted, delivered (to each
+// recipient) and dropped by LossRate.
+func (n *Network) Stats() (posted, delivered, dropped uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.posted, n.delivered, n.dropped
+}
+
+// SetConfig sets the network config, as if it was posted to /config.
+func (n *Network) SetConfig(config string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.config = config
+	n.configRevision++
+}
+
+// Config returns the network config and its revision.
+func (n *Network) Config() (string, uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.config, n.configRevision
+}
+
+func (n *Network) serveHTTP(node int, w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	n.mu.Lock()
+	down := n.down[node]
+	leader := n.leaderLocked()
+	n.mu.Unlock()
+	if down {
+		// Close the connection without a response, like a crashed node.
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		http.Error(w, "node is down", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != "GET" && (strings.HasPrefix(path, "/robustirc/v1/") || path == "/config") {
+		if leader == "" {
+			http.Error(w, "No leader known. Please try another server.", http.StatusInternalServerError)
+			return
+		}
+		// Like RobustIRC followers, which proxy writes to the leader,
+		// indicate the leader in the Content-Location header.
+		if leader != n.servers[node] {
+			location := *r.URL
+			location.Scheme = "https"
+			location.Host = leader
+			w.Header().Set("Content-Location", location.String())
+		}
+	}
+	switch {
+	case path == "/robustirc/v1/session" && r.Method == "POST":
+		n.handleCreateSession(w, r)
+
+	case strings.HasPrefix(path, "/robustirc/v1/"):
+		parts := strings.Split(strings.TrimPrefix(path, "/robustirc/v1/"), "/")
+		id, err := strconv.ParseInt(parts[0], 0, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == "DELETE":
+			n.handleDeleteSession(w, r, id)
+		case len(parts) == 2 && parts[1] == "message" && r.Method == "POST":
+			n.handlePostMessage(w, r, id)
+		case len(parts) == 2 && parts[1] == "messages" && r.Method == "GET":
+			n.handleGetMessages(node, w, r, id)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+		}
+
+	case path == "/config":
+		n.handleConfig(w, r)
+
+	case path == "/":
+		n.handleStatus(node, w, r)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (n *Network) handleStatus(node int, w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	leader := n.leaderLocked()
+	n.mu.Unlock()
+	state := "Follower"
+	switch leader {
+	case "":
+		state = "Candidate"
+	case n.servers[node]:
+		state = "Leader"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		State          string
+		Leader         string
+		Peers          []string
+		AppliedIndex   uint64
+		CommitIndex    uint64
+		LastContact    time.Time
+		ExecutableHash string
+		CurrentTime    time.Time
+	}{
+		State:       state,
+		Leader:      leader,
+		Peers:       n.servers,
+		LastContact: time.Now(),
+		CurrentTime: time.Now(),
+	})
+}
+
+func (n *Network) handleConfig(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-RobustIRC-Config-Revision", strconv.FormatUint(n.configRevision, 10))
+		fmt.Fprint(w, n.config)
+
+	case "POST":
+		revision, err := strconv.ParseUint(r.Header.Get("X-RobustIRC-Config-Revision"), 0, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got, want := revision, n.configRevision; got != want {
+			http.Error(w, fmt.Sprintf("Revision mismatch (got %d, want %d). Try again.", got, want), http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n.config = string(b)
+		n.configRevision++
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// nextIdLocked returns a new, strictly increasing message id.
+func (n *Network) nextIdLocked() int64 {
+	id := time.Now().UnixNano()
+	if id <= n.lastId {
+		id = n.lastId + 1
+	}
+	n.lastId = id
+	return id
+}
+
+func (n *Network) handleCreateSession(w http.ResponseWriter, r *http.Request) {
+	n.mu.Lock()
+	s := &session{
+		id:       robustId{Id: n.nextIdLocked()},
+		auth:     strconv.FormatInt(n.rand.Int63(), 16),
+		channels: make(map[string]bool),
+	}
+	n.sessions[s.id.Id] = s
+	n.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Sessionid   string
+		Sessionauth string
+		Prefix      string
+	}{
+		Sessionid:   strconv.FormatInt(s.id.Id, 10),
+		Sessionauth: s.auth,
+		Prefix:      "robustirc.net",
+	})
+}
+
+// sessionLocked returns the session with the specified id if it exists
+// and the request is authenticated for it.
+func (n *Network) sessionLocked(r *http.Request, id int64) *session {
+	s, ok := n.sessions[id]
+	if !ok || s.deleted || r.Header.Get("X-Session-Auth") != s.auth {
+		return nil
+	}
+	return s
+}
+
+func (n *Network) handleDeleteSession(w http.ResponseWriter, r *http.Request, id int64) {
+	var req struct{ Quitmessage string }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.sessionLocked(r, id)
+	if s == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	n.quitLocked(s, req.Quitmessage)
+}
+
+func (n *Network) quitLocked(s *session, message string) {
+	quit := irc.Message{
+		Prefix:  &irc.Prefix{Name: s.nick, User: "bench", Host: "robustirc"},
+		Command: irc.QUIT,
+		Params:  []string{message},
+	}
+	notified := make(map[*session]bool)
+	for channel := range s.channels {
+		for member := range n.channels[channel] {
+			if member != s && !notified[member] {
+				n.sendLocked(member, quit.String())
+				notified[member] = true
+			}
+		}
+		delete(n.channels[channel], s)
+	}
+	if n.nicks[strings.ToLower(s.nick)] == s {
+		delete(n.nicks, strings.ToLower(s.nick))
+	}
+	s.deleted = true
+	delete(n.sessions, s.id.Id)
+	n.cond.Broadcast()
+}
+
+func (n *Network) handlePostMessage(w http.ResponseWriter, r *http.Request, id int64) {
+	var req struct {
+		Data            string
+		ClientMessageId uint64
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if n.opts.Latency > 0 {
+		time.Sleep(n.opts.Latency)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s := n.sessionLocked(r, id)
+	if s == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+	if n.opts.ErrorRate > 0 && n.rand.Float64() < n.opts.ErrorRate {
+		http.Error(w, "injected error", http.StatusInternalServerError)
+		return
+	}
+	msg := irc.ParseMessage(req.Data)
+	if msg == nil {
+		return
+	}
+	n.handleIRCLocked(s, msg)
+}
+
+func (n *Network) replyLocked(s *session, command string, params ...string) {
+	msg := irc.Message{
+		Prefix:  &irc.Prefix{Name: "robustirc.net"},
+		Command: command,
+		Params:  append([]string{s.nick}, params...),
+	}
+	n.sendLocked(s, msg.String())
+}
+
+func (n *Network) sendLocked(s *session, data string) {
+	s.messages = append(s.messages, robustMessage{
+		Id:      robustId{Id: n.nextIdLocked()},
+		Session: s.id,
+		Type:    typeIRCToClient,
+		Data:    data,
+	})
+	n.cond.Broadcast()
+}
+
+func (n *Network) handleIRCLocked(s *session, msg *irc.Message) {
+	prefix := &irc.Prefix{Name: s.nick, User: "bench", Host: "robustirc"}
+	switch msg.Command {
+	case irc.NICK:
+		if len(msg.Params) < 1 {
+			return
+		}
+		nick := msg.Params[0]
+		if other, ok := n.nicks[strings.ToLower(nick)]; ok && other != s {
+			n.replyLocked(s, irc.ERR_NICKNAMEINUSE, nick, "Nickname is already in use")
+			return
+		}
+		delete(n.nicks, strings.ToLower(s.nick))
+		s.nick = nick
+		n.nicks[strings.ToLower(nick)] = s
+
+	case irc.USER:
+		s.user = true
+
+	case irc.JOIN:
+		if !s.welcomed || len(msg.Params) < 1 {
+			n.replyLocked(s, irc.ERR_NOTREGISTERED, "You have not registered")
+			return
+		}
+		channel := strings.ToLower(msg.Params[0])
+		if n.channels[channel] == nil {
+			n.channels[channel] = make(map[*session]bool)
+		}
+		n.channels[channel][s] = true
+		s.channels[channel] = true
+		join := irc.Message{Prefix: prefix, Command: irc.JOIN, Params: []string{channel}}
+		var nicks []string
+		for member := range n.channels[channel] {
+			n.sendLocked(member, join.String())
+			nicks = append(nicks, member.nick)
+		}
+		n.replyLocked(s, irc.RPL_NAMREPLY, "=", channel, strings.Join(nicks, " "))
+		n.replyLocked(s, irc.RPL_ENDOFNAMES, channel, "End of /NAMES list")
+
+	case irc.PRIVMSG, irc.NOTICE:
+		if !s.welcomed || len(msg.Params) < 2 {
+			return
+		}
+		n.posted++
+		if n.opts.LossRate > 0 && n.rand.Float64() < n.opts.LossRate {
+			n.dropped++
+			return
+		}
+		target := strings.ToLower(msg.Params[0])
+		privmsg := irc.Message{Prefix: prefix, Command: msg.Command, Params: msg.Params}
+		for member := range n.channels[target] {
+			if member != s {
+				n.sendLocked(member, privmsg.String())
+				n.delivered++
+			}
+		}
+
+	case irc.QUIT:
+		message := ""
+		if len(msg.Params) > 0 {
+			message = msg.Params[0]
+		}
+		n.quitLocked(s, message)
+	}
+
+	if !s.welcomed && s.nick != "" && s.user {
+		s.welcomed = true
+		n.replyLocked(s, irc.RPL_WELCOME, "Welcome to fakerobustirc")
+	}
+}
+
+func (n *Network) handleGetMessages(node int, w http.ResponseWriter, r *http.Request, id int64) {
+	var lastseen robustId
+	if parts := strings.SplitN(r.FormValue("lastseen"), ".", 2); len(parts) == 2 {
+		lastseen.Id, _ = strconv.ParseInt(parts[0], 0, 64)
+		lastseen.Reply, _ = strconv.ParseInt(parts[1], 0, 64)
+	}
+
+	n.mu.Lock()
+	s := n.sessionLocked(r, id)
+	n.mu.Unlock()
+	if s == nil {
+		http.Error(w, "No such session", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	if err := enc.Encode(robustMessage{Type: typePing, Servers: n.servers}); err != nil {
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	// Wake up the loop below when the client goes away.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+		case <-done:
+		}
+		n.mu.Lock()
+		n.cond.Broadcast()
+		n.mu.Unlock()
+	}()
+
+	// Skip the messages which the client has already seen.
+	n.mu.Lock()
+	next := 0
+	for next < len(s.messages) && s.messages[next].Id.Id <= lastseen.Id {
+		next++
+	}
+	for {
+		for next >= len(s.messages) && !s.deleted && !n.down[node] && r.Context().Err() == nil {
+			n.cond.Wait()
+		}
+		if s.deleted || n.down[node] || r.Context().Err() != nil {
+			n.mu.Unlock()
+			return
+		}
+		pending := s.messages[next:]
+		next = len(s.messages)
+		n.mu.Unlock()
+
+		for _, msg := range pending {
+			if err := enc.Encode(&msg); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		n.mu.Lock()
+	}
+}
@@ -0,0 +1,54 @@
+// Package kube sets up clients for the Kubernetes API, as used by
+// robustirc-loadtest (which runs outside of the cluster) and throughput
+// (which runs within the cluster during a loadtest).
+package kube
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+)
+
+// NewClient returns a client which uses the service account of the pod
+// when running within a Kubernetes cluster, or the default kubeconfig
+// (e.g. as set up by “gcloud container clusters get-credentials”)
+// otherwise.
+func NewClient() (*kubernetes.Clientset, error) {
+	var (
+		config *rest.Config
+		err    error
+	)
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			clientcmd.NewDefaultClientConfigLoadingRules(),
+			&clientcmd.ConfigOverrides{}).ClientConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// namespaceFile contains the namespace of the pod when running within a
+// Kubernetes cluster.
+const namespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+// Namespace returns the namespace of the pod when running within a
+// Kubernetes cluster, or the default namespace otherwise.
+func Namespace() string {
+	if b, err := ioutil.ReadFile(namespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(b)); namespace != "" {
+			return namespace
+		}
+	}
+	return corev1.NamespaceDefault
+}
@@ -0,0 +1,313 @@
+// Package remotewrite sends metrics to Prometheus remote-write
+// endpoints, and receives them for tests.
+//
+// The wire format is a snappy-compressed (block format) protobuf
+// WriteRequest, see
+// https://github.com/prometheus/prometheus/blob/master/prompb/remote.proto.
+// The few protobuf messages involved are encoded here, like
+// prompb.WriteRequest.Marshal does (see TestEncodeGolden), so that
+// neither the prometheus module nor a protobuf runtime is required.
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type Label struct {
+	Name, Value string
+}
+
+type Sample struct {
+	Value float64
+	// Timestamp is in milliseconds since the epoch.
+	Timestamp int64
+}
+
+// Series is a time series. Labels includes the metric name as label
+// __name__ and is sorted by name.
+type Series struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// FromGatherer converts the metrics of g into series with a single
+// sample at t. Histograms and summaries are converted like Prometheus
+// does when scraping (_bucket, _sum, _count). extra labels are added to
+// all series.
+func FromGatherer(g prometheus.Gatherer, extra []Label, t time.Time) ([]Series, error) {
+	families, err := g.Gather()
+	if err != nil {
+		return nil, err
+	}
+	ts := t.UnixNano() / int64(time.Millisecond)
+	var series []Series
+	add := func(name string, m *dto.Metric, value float64, labels ...Label) {
+		l := []Label{{"__name__", name}}
+		for _, lp := range m.GetLabel() {
+			l = append(l, Label{lp.GetName(), lp.GetValue()})
+		}
+		l = append(l, extra...)
+		l = append(l, labels...)
+		sort.Slice(l, func(i, j int) bool { return l[i].Name < l[j].Name })
+		series = append(series, Series{
+			Labels:  l,
+			Samples: []Sample{{Value: value, Timestamp: ts}},
+		})
+	}
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()),
+						Label{"le", strconv.FormatFloat(b.GetUpperBound(), 'g', -1, 64)})
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), Label{"le", "+Inf"})
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(),
+						Label{"quantile", strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)})
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return series, nil
+}
+
+// Write sends series to the remote-write endpoint url.
+func Write(client *http.Client, url string, series []Series) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(Encode(series)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: unexpected HTTP status %v: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Handler returns a remote-write receiver which calls fn for each
+// request. It is a stand-in for Prometheus in tests.
+func Handler(fn func([]Series)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := Decode(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fn(series)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Encode returns the snappy-compressed WriteRequest for series.
+func Encode(series []Series) []byte {
+	return snappy.Encode(nil, marshal(series))
+}
+
+// marshal returns the protobuf WriteRequest for series. Like all proto3
+// encoders, it omits fields which have their zero value.
+func marshal(series []Series) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for _, l := range s.Labels {
+			var label []byte
+			if l.Name != "" {
+				label = appendBytes(label, 1, []byte(l.Name))
+			}
+			if l.Value != "" {
+				label = appendBytes(label, 2, []byte(l.Value))
+			}
+			ts = appendBytes(ts, 1, label)
+		}
+		for _, sample := range s.Samples {
+			var sb []byte
+			if sample.Value != 0 {
+				sb = appendTag(sb, 1, wireFixed64)
+				sb = appendFixed64(sb, math.Float64bits(sample.Value))
+			}
+			if sample.Timestamp != 0 {
+				sb = appendTag(sb, 2, wireVarint)
+				sb = appendUvarint(sb, uint64(sample.Timestamp))
+			}
+			ts = appendBytes(ts, 2, sb)
+		}
+		req = appendBytes(req, 1, ts)
+	}
+	return req
+}
+
+// Decode parses a snappy-compressed WriteRequest.
+func Decode(b []byte) ([]Series, error) {
+	req, err := snappy.Decode(nil, b)
+	if err != nil {
+		return nil, fmt.Errorf("remotewrite: %v", err)
+	}
+	return unmarshal(req)
+}
+
+// unmarshal parses a protobuf WriteRequest.
+func unmarshal(req []byte) ([]Series, error) {
+	var series []Series
+	err := parseMessage(req, func(field int, value []byte, _ uint64) error {
+		if field != 1 {
+			return nil
+		}
+		var s Series
+		err := parseMessage(value, func(field int, value []byte, _ uint64) error {
+			switch field {
+			case 1:
+				var l Label
+				err := parseMessage(value, func(field int, value []byte, _ uint64) error {
+					switch field {
+					case 1:
+						l.Name = string(value)
+					case 2:
+						l.Value = string(value)
+					}
+					return nil
+				})
+				s.Labels = append(s.Labels, l)
+				return err
+			case 2:
+				var sample Sample
+				err := parseMessage(value, func(field int, _ []byte, n uint64) error {
+					switch field {
+					case 1:
+						sample.Value = math.Float64frombits(n)
+					case 2:
+						sample.Timestamp = int64(n)
+					}
+					return nil
+				})
+				s.Samples = append(s.Samples, sample)
+				return err
+			}
+			return nil
+		})
+		series = append(series, s)
+		return err
+	})
+	return series, err
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendFixed64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return appendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendTag(b, field, wireBytes)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+var errTruncated = errors.New("remotewrite: truncated message")
+
+// parseMessage calls fn for each field of the protobuf message b, with
+// the contents of length-delimited fields or the value of numeric
+// fields.
+func parseMessage(b []byte, fn func(field int, value []byte, n uint64) error) error {
+	for len(b) > 0 {
+		tag, l := binary.Uvarint(b)
+		if l <= 0 {
+			return errTruncated
+		}
+		b = b[l:]
+		var (
+			value []byte
+			n     uint64
+		)
+		switch tag & 7 {
+		case wireVarint:
+			n, l = binary.Uvarint(b)
+			if l <= 0 {
+				return errTruncated
+			}
+			b = b[l:]
+		case wireFixed64:
+			if len(b) < 8 {
+				return errTruncated
+			}
+			n = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case wireFixed32:
+			if len(b) < 4 {
+				return errTruncated
+			}
+			n = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		case wireBytes:
+			size, l := binary.Uvarint(b)
+			if l <= 0 || uint64(len(b)-l) < size {
+				return errTruncated
+			}
+			value = b[l : l+int(size)]
+			b = b[l+int(size):]
+		default:
+			return fmt.Errorf("remotewrite: unsupported wire type %d", tag&7)
+		}
+		if err := fn(int(tag>>3), value, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
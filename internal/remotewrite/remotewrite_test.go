@@ -0,0 +1,105 @@
+package remotewrite
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// golden is a WriteRequest as encoded by prompb.WriteRequest.Marshal
+// (github.com/prometheus/prometheus v0.37.0) for goldenSeries.
+var golden = []byte{
+	0x0a, 0x45, 0x0a, 0x16, 0x0a, 0x08, 0x5f, 0x5f, 0x6e, 0x61, 0x6d, 0x65,
+	0x5f, 0x5f, 0x12, 0x0a, 0x73, 0x65, 0x6e, 0x74, 0x5f, 0x74, 0x6f, 0x74,
+	0x61, 0x6c, 0x0a, 0x0c, 0x0a, 0x06, 0x72, 0x75, 0x6e, 0x5f, 0x69, 0x64,
+	0x12, 0x02, 0x72, 0x31, 0x0a, 0x0b, 0x0a, 0x06, 0x73, 0x65, 0x72, 0x76,
+	0x65, 0x72, 0x12, 0x01, 0x61, 0x12, 0x10, 0x09, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x08, 0x40, 0x10, 0x80, 0x80, 0xba, 0xbb, 0xc8, 0x2e, 0x0a,
+	0x43, 0x0a, 0x1a, 0x0a, 0x08, 0x5f, 0x5f, 0x6e, 0x61, 0x6d, 0x65, 0x5f,
+	0x5f, 0x12, 0x0e, 0x6c, 0x61, 0x74, 0x65, 0x6e, 0x63, 0x79, 0x5f, 0x62,
+	0x75, 0x63, 0x6b, 0x65, 0x74, 0x0a, 0x0a, 0x0a, 0x02, 0x6c, 0x65, 0x12,
+	0x04, 0x30, 0x2e, 0x32, 0x35, 0x12, 0x07, 0x10, 0x80, 0x80, 0xba, 0xbb,
+	0xc8, 0x2e, 0x12, 0x10, 0x09, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8,
+	0xbf, 0x10, 0xe8, 0x87, 0xba, 0xbb, 0xc8, 0x2e,
+}
+
+var goldenSeries = []Series{
+	{
+		Labels:  []Label{{"__name__", "sent_total"}, {"run_id", "r1"}, {"server", "a"}},
+		Samples: []Sample{{Value: 3, Timestamp: 1600000000000}},
+	},
+	{
+		Labels: []Label{{"__name__", "latency_bucket"}, {"le", "0.25"}},
+		// A zero value is omitted from the encoding.
+		Samples: []Sample{{Value: 0, Timestamp: 1600000000000}, {Value: -1.5, Timestamp: 1600000001000}},
+	},
+}
+
+func TestEncodeGolden(t *testing.T) {
+	if got := marshal(goldenSeries); !bytes.Equal(got, golden) {
+		t.Errorf("marshal:\ngot  %#v\nwant %#v", got, golden)
+	}
+	got, err := unmarshal(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, goldenSeries) {
+		t.Errorf("unmarshal: got %+v, want %+v", got, goldenSeries)
+	}
+
+	if _, err := Decode([]byte("not snappy")); err == nil {
+		t.Errorf("Decode of invalid input unexpectedly succeeded")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "sent", Help: "h"}, []string{"server"})
+	counter.WithLabelValues("a").Add(3)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Help: "h", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	reg.MustRegister(counter, histogram)
+
+	now := time.Unix(1600000000, 0)
+	series, err := FromGatherer(reg, []Label{{"run_id", "r1"}}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received []Series
+	srv := httptest.NewServer(Handler(func(s []Series) { received = s }))
+	defer srv.Close()
+	if err := Write(http.DefaultClient, srv.URL, series); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, series) {
+		t.Fatalf("received %+v, want %+v", received, series)
+	}
+
+	var names []string
+	for _, s := range received {
+		var name string
+		for _, l := range s.Labels {
+			if l.Name == "__name__" {
+				name = l.Value
+			}
+		}
+		names = append(names, name)
+	}
+	if got, want := strings.Join(names, ","), "latency_bucket,latency_bucket,latency_sum,latency_count,sent"; got != want {
+		t.Errorf("series: got %s, want %s", got, want)
+	}
+	want := Series{
+		Labels:  []Label{{"__name__", "sent"}, {"run_id", "r1"}, {"server", "a"}},
+		Samples: []Sample{{Value: 3, Timestamp: 1600000000000}},
+	}
+	if got := received[len(received)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("counter: got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,524 @@
+// Package robustclient is a RobustIRC session client, modeled after
+// github.com/robustirc/bridge/robustsession, for benchmarking: its HTTP
+// client and the servers each session talks to are configurable, and
+// it reports which server handled each request.
+package robustclient
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pathCreateSession = "/robustirc/v1/session"
+	pathDeleteSession = "/robustirc/v1/%s"
+	pathPostMessage   = "/robustirc/v1/%s/message"
+	pathGetMessages   = "/robustirc/v1/%s/messages?lastseen=%s"
+)
+
+const userAgent = "RobustIRC benchmark"
+
+type robustId struct {
+	Id    int64
+	Reply int64
+}
+
+func (i *robustId) String() string {
+	return fmt.Sprintf("%d.%d", i.Id, i.Reply)
+}
+
+// Message types, see robustsession.
+const (
+	robustIRCToClient = 3
+	robustPing        = 4
+)
+
+type robustMessage struct {
+	Id   robustId
+	Type int64
+	Data string
+
+	// Only present when Type == robustPing.
+	Servers []string `json:",omitempty"`
+}
+
+var NoSuchSession = errors.New("No such RobustIRC session (killed by the network?)")
+
+// TransportOptions configures the HTTP client used by sessions. The zero
+// value results in the same settings as robustsession uses.
+type TransportOptions struct {
+	TLSConfig *tls.Config
+
+	// DialTimeout defaults to 5s.
+	DialTimeout time.Duration
+
+	// KeepAlive is the TCP keep-alive period, defaults to 30s.
+	KeepAlive time.Duration
+
+	// TLSHandshakeTimeout defaults to 10s.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout limits how long to wait for the response
+	// headers of a request. 0 means no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout limits how long idle connections are kept open.
+	// 0 means no limit.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConnsPerHost defaults to 1.
+	MaxIdleConnsPerHost int
+
+	// DisableKeepAlives makes every request use a new connection.
+	DisableKeepAlives bool
+}
+
+// NewClient returns an HTTP client for use in Options.
+func NewClient(opts TransportOptions) *http.Client {
+	if opts.DialTimeout == 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	if opts.KeepAlive == 0 {
+		opts.KeepAlive = 30 * time.Second
+	}
+	if opts.TLSHandshakeTimeout == 0 {
+		opts.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if opts.MaxIdleConnsPerHost == 0 {
+		opts.MaxIdleConnsPerHost = 1
+	}
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: opts.KeepAlive,
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			TLSClientConfig:       opts.TLSConfig,
+			Proxy:                 http.ProxyFromEnvironment,
+			TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+			ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+			IdleConnTimeout:       opts.IdleConnTimeout,
+			MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+			DisableKeepAlives:     opts.DisableKeepAlives,
+		},
+	}
+}
+
+// Options configures a session.
+type Options struct {
+	// Servers is the list of host:port addresses of the network.
+	Servers []string
+
+	// Target is the server which the session sends its requests to. If
+	// empty, the first server is used. Other servers are only used when
+	// Target fails, unless Pinned is set.
+	Target string
+
+	// Pinned restricts the session to Target: failed requests are
+	// retried on Target only.
+	Pinned bool
+
+	// FollowLeader makes the session switch its Target to the leader
+	// when a follower proxied a request to it, like robustsession does.
+	FollowLeader bool
+
+	// Client is the HTTP client to use. Sessions can share a client to
+	// share a connection pool. If nil, the session uses its own client,
+	// configured by Transport.
+	Client *http.Client
+
+	Transport TransportOptions
+
+	// RequestFailed, if non-nil, is called for each failed request
+	// (including requests which are retried).
+	RequestFailed func(server string, err error)
+}
+
+// Served describes which servers handled a request.
+type Served struct {
+	// Server is the server the request was sent to.
+	Server string
+
+	// ProxiedTo is the server (i.e. the leader) which Server proxied the
+	// request to, or empty if Server handled the request itself.
+	ProxiedTo string
+}
+
+// Handler returns the server which handled the request.
+func (s Served) Handler() string {
+	if s.ProxiedTo != "" {
+		return s.ProxiedTo
+	}
+	return s.Server
+}
+
+type backoffState struct {
+	exp  float64
+	next time.Time
+}
+
+// Session is a RobustIRC session. The caller must read the Messages and
+// Errors channels.
+type Session struct {
+	Messages chan string
+	Errors   chan error
+
+	sessionId   string
+	sessionAuth string
+	served      Served
+	client      *http.Client
+	ownClient   bool
+	pinned      bool
+	follow      bool
+	onFailure   func(server string, err error)
+
+	deleted int32 // atomic
+	done    chan bool
+
+	// sendingMu serializes PostMessage calls, as required by the
+	// RobustIRC protocol.
+	sendingMu sync.Mutex
+
+	mu        sync.Mutex
+	servers   []string
+	target    string
+	backoff   map[string]backoffState
+	streaming string // server which GetMessages is currently streaming from
+}
+
+// Create creates a new session.
+func Create(opts Options) (*Session, error) {
+	if len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("no servers specified")
+	}
+	s := &Session{
+		Messages:  make(chan string),
+		Errors:    make(chan error),
+		done:      make(chan bool),
+		client:    opts.Client,
+		pinned:    opts.Pinned,
+		follow:    opts.FollowLeader,
+		onFailure: opts.RequestFailed,
+		servers:   append([]string(nil), opts.Servers...),
+		target:    opts.Target,
+		backoff:   make(map[string]backoffState),
+	}
+	if s.target == "" {
+		s.target = s.servers[0]
+	}
+	if s.client == nil {
+		s.client = NewClient(opts.Transport)
+		s.ownClient = true
+	}
+
+	served, resp, err := s.sendRequest("POST", pathCreateSession, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer discardResponse(resp)
+
+	var createSessionReply struct {
+		Sessionid   string
+		Sessionauth string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&createSessionReply); err != nil {
+		return nil, err
+	}
+	s.sessionId = createSessionReply.Sessionid
+	s.sessionAuth = createSessionReply.Sessionauth
+	s.served = served
+
+	go s.getMessages()
+
+	return s, nil
+}
+
+// SessionId returns a string that identifies the session.
+func (s *Session) SessionId() string {
+	return s.sessionId
+}
+
+// Served returns which servers handled the creation of the session.
+func (s *Session) Served() Served {
+	return s.served
+}
+
+// Target returns the server which the next request will most likely be
+// sent to (unless it is backed off).
+func (s *Session) Target() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.target
+}
+
+// Streaming returns the server from which messages are currently
+// received, or empty if there is none.
+func (s *Session) Streaming() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streaming
+}
+
+func (s *Session) isDeleted() bool {
+	return atomic.LoadInt32(&s.deleted) == 1
+}
+
+// server returns the server to send the next request to. In case
+// back-off prevents sending a request anywhere right now, it blocks
+// until back-off is over.
+func (s *Session) server() string {
+	for {
+		s.mu.Lock()
+		candidates := []string{s.target}
+		if !s.pinned {
+			candidates = append(candidates, s.servers...)
+		}
+		soonest := time.Duration(math.MaxInt64)
+		for _, server := range candidates {
+			wait := time.Until(s.backoff[server].next)
+			if wait <= 0 {
+				s.mu.Unlock()
+				return server
+			}
+			if wait < soonest {
+				soonest = wait
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(soonest)
+	}
+}
+
+func (s *Session) failed(server string, err error) {
+	if s.onFailure != nil {
+		s.onFailure(server, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.backoff[server]
+	// Cap the exponential backoff at 2^6 = 64 seconds, see robustsession.
+	if b.exp < 6 {
+		b.exp++
+	}
+	b.next = time.Now().Add(time.Duration(math.Pow(2, b.exp)) * time.Second)
+	s.backoff[server] = b
+}
+
+func (s *Session) succeeded(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.backoff, server)
+}
+
+func (s *Session) setServers(servers []string) {
+	if len(servers) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+func (s *Session) setStreaming(server string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streaming = server
+}
+
+func discardResponse(resp *http.Response) {
+	// We need to read the entire body, otherwise net/http will not
+	// re-use this connection.
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func (s *Session) sendRequest(method, path string, data []byte) (Served, *http.Response, error) {
+	for !s.isDeleted() {
+		target := s.server()
+		requrl := fmt.Sprintf("https://%s%s", target, path)
+		req, err := http.NewRequest(method, requrl, bytes.NewBuffer(data))
+		if err != nil {
+			return Served{}, nil, err
+		}
+		req.Header.Set("User-Agent", userAgent)
+		req.Header.Set("X-Session-Auth", s.sessionAuth)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := s.client.Do(req)
+		if err != nil {
+			s.failed(target, err)
+			log.Printf("Warning: %s: %v (trying again)\n", requrl, err)
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			served := Served{Server: target}
+			if cl := resp.Header.Get("Content-Location"); cl != "" {
+				if location, err := url.Parse(cl); err == nil && location.Host != target {
+					served.ProxiedTo = location.Host
+					if s.follow && !s.pinned {
+						s.mu.Lock()
+						s.target = location.Host
+						s.mu.Unlock()
+					}
+				}
+			}
+			return served, resp, nil
+		}
+		message, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		s.failed(target, fmt.Errorf("%v: %q", resp.Status, message))
+		if resp.StatusCode == http.StatusNotFound {
+			return Served{}, nil, fmt.Errorf("Error: %s: %v (non-recoverable)", requrl, NoSuchSession)
+		}
+		// Server errors, temporary.
+		if resp.StatusCode >= 500 && resp.StatusCode < 600 {
+			log.Printf("Warning: %s: %v: %q (trying again)\n", requrl, resp.Status, message)
+			continue
+		}
+		// Client errors and anything unexpected, assumed to be permanent.
+		return Served{}, nil, fmt.Errorf("Error: %s: %v: %q (non-recoverable)", requrl, resp.Status, message)
+	}
+	return Served{}, nil, NoSuchSession
+}
+
+func (s *Session) getMessages() {
+	var lastseen robustId
+
+	defer func() {
+		for range s.done {
+		}
+	}()
+
+	for !s.isDeleted() {
+		served, resp, err := s.sendRequest("GET", fmt.Sprintf(pathGetMessages, s.sessionId, lastseen.String()), nil)
+		if err != nil {
+			s.Errors <- err
+			return
+		}
+		s.setStreaming(served.Handler())
+
+		dec := json.NewDecoder(resp.Body)
+		for !s.isDeleted() {
+			var msg robustMessage
+			if err := dec.Decode(&msg); err != nil {
+				if !s.isDeleted() {
+					log.Printf("Protocol error on %q: Could not decode response chunk as JSON: %v\n", served.Server, err)
+					s.failed(served.Server, err)
+				}
+				break
+			}
+			switch msg.Type {
+			case robustPing:
+				s.setServers(msg.Servers)
+			case robustIRCToClient:
+				s.Messages <- msg.Data
+				lastseen = msg.Id
+			}
+		}
+		s.setStreaming("")
+
+		// Cannot use discardResponse() because the response never completes.
+		resp.Body.Close()
+
+		// Delay reconnecting for somewhere in between [250, 500) ms to avoid
+		// overloading the remaining servers from many clients at once when one
+		// server fails.
+		time.Sleep(time.Duration(250+rand.Int63n(250)) * time.Millisecond)
+	}
+}
+
+// PostMessage posts the given IRC message. It retries on transient
+// errors and only returns an error when the network returned a
+// permanent error, such as NoSuchSession.
+func (s *Session) PostMessage(message string) error {
+	_, err := s.Post(message)
+	return err
+}
+
+// Post is like PostMessage, but also returns which servers handled the
+// request.
+func (s *Session) Post(message string) (Served, error) {
+	s.sendingMu.Lock()
+	defer s.sendingMu.Unlock()
+
+	// See robustsession for why the message id is derived from the
+	// message.
+	h := fnv.New32()
+	h.Write([]byte(message))
+	msgid := (uint64(h.Sum32()) << 32) | uint64(rand.Int31n(math.MaxInt32))
+
+	b, err := json.Marshal(struct {
+		Data            string
+		ClientMessageId uint64
+	}{
+		Data:            message,
+		ClientMessageId: msgid,
+	})
+	if err != nil {
+		return Served{}, fmt.Errorf("Message could not be encoded as JSON: %v", err)
+	}
+
+	served, resp, err := s.sendRequest("POST", fmt.Sprintf(pathPostMessage, s.sessionId), b)
+	if err != nil {
+		return Served{}, err
+	}
+	discardResponse(resp)
+	s.succeeded(served.Server)
+	return served, nil
+}
+
+// Delete sends a delete request for this session. The session must not
+// be used after Delete returns, even if the request failed.
+func (s *Session) Delete(quitmessage string) error {
+	defer func() {
+		atomic.StoreInt32(&s.deleted, 1)
+
+		// Make sure nobody is blocked on sending to the channels by
+		// reading all remaining values.
+		go func() {
+			for range s.Messages {
+			}
+		}()
+		go func() {
+			for range s.Errors {
+			}
+		}()
+
+		// This will be read by getMessages(), which will not send on the
+		// channels after reading it, so we can safely close them.
+		s.done <- true
+		close(s.done)
+
+		close(s.Messages)
+		close(s.Errors)
+
+		if s.ownClient {
+			s.client.CloseIdleConnections()
+		}
+	}()
+
+	b, err := json.Marshal(struct{ Quitmessage string }{quitmessage})
+	if err != nil {
+		return err
+	}
+	_, resp, err := s.sendRequest("DELETE", fmt.Sprintf(pathDeleteSession, s.sessionId), b)
+	if err != nil {
+		return err
+	}
+	discardResponse(resp)
+	return nil
+}
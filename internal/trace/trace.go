@@ -0,0 +1,143 @@
+// Package trace defines an anonymized IRC traffic trace format, which
+// captures the timing and shape of real traffic (commands, channels,
+// message sizes and inter-arrival times), but no identities or
+// contents.
+//
+// A trace file contains one JSON-encoded Event per line, ordered by
+// Offset.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// Event is a single IRC message sent by a client.
+type Event struct {
+	// Offset is the time since the start of the trace.
+	Offset time.Duration `json:"offset"`
+
+	// Session is the anonymized sender, numbered from 0 in order of
+	// appearance.
+	Session int `json:"session"`
+
+	// Command is the IRC command, e.g. PRIVMSG.
+	Command string `json:"command"`
+
+	// Channel is the anonymized target channel, numbered from 0 in order
+	// of appearance, or -1 if the message was not sent to a channel.
+	Channel int `json:"channel"`
+
+	// Size is the length (in bytes) of the raw IRC message as sent by
+	// the client, i.e. without prefix.
+	Size int `json:"size"`
+}
+
+// Anonymizer turns IRC messages into Events.
+type Anonymizer struct {
+	start    time.Time
+	sessions map[string]int
+	channels map[string]int
+}
+
+func NewAnonymizer() *Anonymizer {
+	return &Anonymizer{
+		sessions: make(map[string]int),
+		channels: make(map[string]int),
+	}
+}
+
+func (a *Anonymizer) session(name string) int {
+	name = strings.ToLower(name)
+	idx, ok := a.sessions[name]
+	if !ok {
+		idx = len(a.sessions)
+		a.sessions[name] = idx
+	}
+	return idx
+}
+
+func (a *Anonymizer) channel(name string) int {
+	name = strings.ToLower(name)
+	idx, ok := a.channels[name]
+	if !ok {
+		idx = len(a.channels)
+		a.channels[name] = idx
+	}
+	return idx
+}
+
+// Event anonymizes msg, which was sent by sender at t. Messages must be
+// passed in chronological order.
+func (a *Anonymizer) Event(t time.Time, sender string, msg *irc.Message) Event {
+	if a.start.IsZero() {
+		a.start = t
+	}
+	unprefixed := *msg
+	unprefixed.Prefix = nil
+	ev := Event{
+		Offset:  t.Sub(a.start),
+		Session: a.session(sender),
+		Command: msg.Command,
+		Channel: -1,
+		Size:    unprefixed.Len(),
+	}
+	if len(msg.Params) > 0 && strings.HasPrefix(msg.Params[0], "#") {
+		ev.Channel = a.channel(msg.Params[0])
+	}
+	return ev
+}
+
+// Writer writes trace files.
+type Writer struct {
+	enc *json.Encoder
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{enc: json.NewEncoder(w)}
+}
+
+func (w *Writer) Write(ev Event) error {
+	return w.enc.Encode(&ev)
+}
+
+// Read reads all events from r.
+func Read(r io.Reader) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if n := len(events); n > 0 && ev.Offset < events[n-1].Offset {
+			return nil, fmt.Errorf("line %d: offset %v is before the previous offset %v", line, ev.Offset, events[n-1].Offset)
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// ReadFile reads all events from the trace file at path.
+func ReadFile(path string) ([]Event, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	events, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return events, nil
+}
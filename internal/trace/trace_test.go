@@ -0,0 +1,51 @@
+package trace
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/sorcix/irc.v2"
+)
+
+func TestRoundTrip(t *testing.T) {
+	start := time.Unix(1471096246, 0)
+	a := NewAnonymizer()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for i, raw := range []string{
+		":alice!a@example.net PRIVMSG #robustirc :hello",
+		":bob!b@example.net PRIVMSG #RobustIRC :hi alice",
+		":alice!a@example.net PRIVMSG bob :secret",
+		":Bob!b@example.net NOTICE #other :ping",
+	} {
+		msg := irc.ParseMessage(raw)
+		if err := w.Write(a.Event(start.Add(time.Duration(i)*time.Second), msg.Prefix.Name, msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Event{
+		{Offset: 0, Session: 0, Command: "PRIVMSG", Channel: 0, Size: len("PRIVMSG #robustirc hello")},
+		{Offset: 1 * time.Second, Session: 1, Command: "PRIVMSG", Channel: 0, Size: len("PRIVMSG #RobustIRC :hi alice")},
+		{Offset: 2 * time.Second, Session: 0, Command: "PRIVMSG", Channel: -1, Size: len("PRIVMSG bob secret")},
+		{Offset: 3 * time.Second, Session: 1, Command: "NOTICE", Channel: 1, Size: len("NOTICE #other ping")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("unexpected events: got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadRejectsUnorderedEvents(t *testing.T) {
+	in := `{"offset":2,"session":0,"command":"PRIVMSG","channel":0,"size":10}
+{"offset":1,"session":0,"command":"PRIVMSG","channel":0,"size":10}
+`
+	if _, err := Read(bytes.NewBufferString(in)); err == nil {
+		t.Fatalf("Read unexpectedly succeeded")
+	}
+}
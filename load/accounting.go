@@ -0,0 +1,204 @@
+package load
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// benchPayload is the trailing parameter of each benchmark PRIVMSG. It
+// may be followed by padding, see benchMessage.
+type benchPayload struct {
+	Sender int
+	Seq    uint64
+	Sent   int64 // UnixNano
+}
+
+func (p benchPayload) String() string {
+	return fmt.Sprintf("%d %d %d", p.Sender, p.Seq, p.Sent)
+}
+
+func parseBenchPayload(s string) (benchPayload, error) {
+	var p benchPayload
+	fields := strings.Fields(s)
+	if got, want := len(fields), 3; got != want && got != want+1 {
+		return p, fmt.Errorf("unexpected number of fields in %q: got %d, want %d (plus padding)", s, got, want)
+	}
+	var err error
+	if p.Sender, err = strconv.Atoi(fields[0]); err != nil {
+		return p, err
+	}
+	if p.Seq, err = strconv.ParseUint(fields[1], 0, 64); err != nil {
+		return p, err
+	}
+	if p.Sent, err = strconv.ParseInt(fields[2], 0, 64); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// senderStats tracks the messages of a single sender. Sequence numbers
+// start at 1.
+type senderStats struct {
+	sent       uint64
+	received   uint64 // unique
+	duplicated uint64
+	reordered  uint64
+
+	// highest is the highest sequence number received so far.
+	highest uint64
+	// missing contains all sequence numbers below highest which were
+	// not received (yet).
+	missing map[uint64]bool
+}
+
+// accounting correlates sent and received messages per sender so that
+// lost messages can be told apart from slow ones.
+type accounting struct {
+	metrics *metrics
+
+	mu      sync.Mutex
+	senders map[int]*senderStats
+}
+
+func newAccounting(m *metrics) *accounting {
+	return &accounting{
+		metrics: m,
+		senders: make(map[int]*senderStats),
+	}
+}
+
+func (a *accounting) statsLocked(sender int) *senderStats {
+	s, ok := a.senders[sender]
+	if !ok {
+		s = &senderStats{missing: make(map[uint64]bool)}
+		a.senders[sender] = s
+	}
+	return s
+}
+
+// sent records that sender successfully posted the message with
+// sequence number seq.
+func (a *accounting) sent(sender int, seq uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.statsLocked(sender)
+	if seq > s.sent {
+		s.sent = seq
+	}
+}
+
+// received records the receipt of a message.
+func (a *accounting) received(p benchPayload) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := a.statsLocked(p.Sender)
+	switch {
+	case p.Seq > s.highest:
+		for seq := s.highest + 1; seq < p.Seq; seq++ {
+			s.missing[seq] = true
+			a.metrics.missing.Inc()
+		}
+		s.highest = p.Seq
+		s.received++
+
+	case s.missing[p.Seq]:
+		delete(s.missing, p.Seq)
+		a.metrics.missing.Dec()
+		s.received++
+		s.reordered++
+		a.metrics.reordered.Inc()
+
+	default:
+		s.duplicated++
+		a.metrics.duplicated.Inc()
+	}
+}
+
+// AccountingSummary counts the messages of one or all senders.
+type AccountingSummary struct {
+	Sent       uint64
+	Received   uint64
+	Lost       uint64
+	Duplicated uint64
+	Reordered  uint64
+}
+
+func (s *senderStats) summary() AccountingSummary {
+	sum := AccountingSummary{
+		Sent:       s.sent,
+		Received:   s.received,
+		Duplicated: s.duplicated,
+		Reordered:  s.reordered,
+	}
+	// A message which was received, but whose PostMessage call did not
+	// return (yet) is not lost.
+	if s.sent > s.received {
+		sum.Lost = s.sent - s.received
+	}
+	return sum
+}
+
+func (a *accounting) perSender() map[int]AccountingSummary {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := make(map[int]AccountingSummary, len(a.senders))
+	for sender, s := range a.senders {
+		result[sender] = s.summary()
+	}
+	return result
+}
+
+func (a *accounting) total() AccountingSummary {
+	var total AccountingSummary
+	for _, s := range a.perSender() {
+		total.Sent += s.Sent
+		total.Received += s.Received
+		total.Lost += s.Lost
+		total.Duplicated += s.Duplicated
+		total.Reordered += s.Reordered
+	}
+	return total
+}
+
+// logReport logs the message accounting of all senders which saw
+// loss, duplication or reordering, followed by the totals.
+func (a *accounting) logReport() {
+	perSender := a.perSender()
+	senders := make([]int, 0, len(perSender))
+	for sender := range perSender {
+		senders = append(senders, sender)
+	}
+	sort.Ints(senders)
+	for _, sender := range senders {
+		s := perSender[sender]
+		if s.Lost == 0 && s.Duplicated == 0 && s.Reordered == 0 {
+			continue
+		}
+		log.Printf("session %d: sent %d, recv %d, lost %d, duplicated %d, reordered %d",
+			sender, s.Sent, s.Received, s.Lost, s.Duplicated, s.Reordered)
+	}
+	total := a.total()
+	a.metrics.lost.Set(float64(total.Lost))
+	log.Printf("total: sent %d, recv %d, lost %d, duplicated %d, reordered %d",
+		total.Sent, total.Received, total.Lost, total.Duplicated, total.Reordered)
+}
+
+// merge adds the per-sender accounting of another process (see
+// perSender) to a. Since a message is only sent by one process and
+// only received by the receiving session’s process, adding up the
+// counters of all processes yields the overall accounting.
+func (a *accounting) merge(perSender map[int]AccountingSummary) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for sender, other := range perSender {
+		s := a.statsLocked(sender)
+		s.sent += other.Sent
+		s.received += other.Received
+		s.duplicated += other.Duplicated
+		s.reordered += other.Reordered
+	}
+}
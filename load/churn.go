@@ -0,0 +1,120 @@
+package load
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// errChurned is returned by runWorker when the session was torn down
+// by the churn workload (as opposed to failing).
+var errChurned = errors.New("session churned")
+
+// errStopped is returned by runWorker when the session was removed (see
+// sessionGroup.removeSessions) or the Runner was closed.
+var errStopped = errors.New("session removed")
+
+// churner tears down Options.ChurnRate of the sending sessions per
+// second by signaling their runWorker.
+type churner struct {
+	// first and count are the range of sessions which are run by this
+	// process and can be churned. The receiving session (index 0) is
+	// never churned.
+	first, count int
+	// carry accumulates fractional sessions between ticks so that low
+	// rates still result in churn.
+	carry float64
+
+	mu sync.Mutex
+	// signals contains one channel per session, indexed by session.
+	signals []chan struct{}
+	active  bool
+	latency [2]struct {
+		sum   time.Duration
+		count int64
+	}
+}
+
+func newChurner(sessions, first, count int) *churner {
+	if first == 0 {
+		first, count = 1, count-1
+	}
+	c := &churner{
+		signals: make([]chan struct{}, sessions),
+		first:   first,
+		count:   count,
+	}
+	for idx := range c.signals {
+		c.signals[idx] = make(chan struct{}, 1)
+	}
+	return c
+}
+
+// signal returns the channel which signals session idx to churn.
+func (c *churner) signal(idx int) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.signals[idx]
+}
+
+// add makes n more sessions (following the existing ones) churnable.
+func (c *churner) add(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < n; i++ {
+		c.signals = append(c.signals, make(chan struct{}, 1))
+	}
+	c.count += n
+}
+
+// tick churns the sessions which are due. It must be called once per
+// second.
+func (c *churner) tick(rate float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active {
+		log.Printf("starting to churn %.1f%% of sessions per second", rate*100)
+		c.active = true
+	}
+
+	if c.count < 1 {
+		return
+	}
+	c.carry += rate * float64(c.count)
+	for ; c.carry >= 1; c.carry-- {
+		idx := c.first + rand.Intn(c.count)
+		select {
+		case c.signals[idx] <- struct{}{}:
+		default:
+			// The session has not picked up the previous signal yet.
+		}
+	}
+}
+
+// observeLatency records message latency separately for before and
+// during churn, so that the effect of churn can be reported.
+func (c *churner) observeLatency(latency time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	idx := 0
+	if c.active {
+		idx = 1
+	}
+	c.latency[idx].sum += latency
+	c.latency[idx].count++
+}
+
+func (c *churner) logReport() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	mean := func(idx int) time.Duration {
+		if c.latency[idx].count == 0 {
+			return 0
+		}
+		return c.latency[idx].sum / time.Duration(c.latency[idx].count)
+	}
+	log.Printf("mean message latency before churn: %v (%d messages), during churn: %v (%d messages)",
+		mean(0), c.latency[0].count, mean(1), c.latency[1].count)
+}
@@ -0,0 +1,180 @@
+package load
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// hdrSubBucketBits determines the precision of Histogram: each
+// power-of-two range is split into 2^(hdrSubBucketBits-1) sub-buckets,
+// i.e. values are recorded with a relative error of at most
+// 2^-(hdrSubBucketBits-1) ≈ 0.1%.
+const hdrSubBucketBits = 11
+
+const (
+	hdrSubBuckets     = 1 << hdrSubBucketBits
+	hdrHalfSubBuckets = hdrSubBuckets / 2
+)
+
+// Histogram is a high dynamic range histogram in the spirit of
+// http://hdrhistogram.org/: it records durations from 1ns up to the
+// maximum time.Duration with constant relative precision and constant
+// memory, so that quantiles can be computed without choosing buckets
+// upfront.
+type Histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	total  uint64
+	min    time.Duration
+	max    time.Duration
+}
+
+// NewHistogram returns an empty Histogram.
+func NewHistogram() *Histogram {
+	return &Histogram{
+		counts: make([]uint64, hdrSubBuckets+64*hdrHalfSubBuckets),
+		min:    math.MaxInt64,
+	}
+}
+
+func hdrIndex(v uint64) int {
+	if v < hdrSubBuckets {
+		return int(v)
+	}
+	shift := bits.Len64(v) - hdrSubBucketBits
+	mantissa := v >> uint(shift)
+	return hdrSubBuckets + (shift-1)*hdrHalfSubBuckets + int(mantissa-hdrHalfSubBuckets)
+}
+
+// hdrValue returns the midpoint of the values which are recorded at
+// index idx.
+func hdrValue(idx int) uint64 {
+	if idx < hdrSubBuckets {
+		return uint64(idx)
+	}
+	idx -= hdrSubBuckets
+	shift := uint(idx/hdrHalfSubBuckets + 1)
+	mantissa := uint64(idx%hdrHalfSubBuckets + hdrHalfSubBuckets)
+	return mantissa<<shift + (1<<shift)/2
+}
+
+// Record records d. Negative durations are recorded as 0.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[hdrIndex(uint64(d))]++
+	h.total++
+	if d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Reset removes all recorded values.
+func (h *Histogram) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for idx := range h.counts {
+		h.counts[idx] = 0
+	}
+	h.total = 0
+	h.min = math.MaxInt64
+	h.max = 0
+}
+
+// Count returns the number of recorded values.
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.total
+}
+
+// Quantile returns the value at quantile q (e.g. 0.99), or 0 if no
+// values were recorded.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return h.min
+	}
+	if q >= 1 {
+		return h.max
+	}
+	rank := uint64(math.Ceil(q * float64(h.total)))
+	var seen uint64
+	for idx, count := range h.counts {
+		if seen += count; seen >= rank {
+			d := time.Duration(hdrValue(idx))
+			// The midpoint of a bucket can lie outside of the recorded
+			// range.
+			if d < h.min {
+				return h.min
+			}
+			if d > h.max {
+				return h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+// HistogramSnapshot is the serializable state of a Histogram,
+// containing only the non-empty buckets.
+type HistogramSnapshot struct {
+	Counts map[int]uint64 `json:"counts"`
+	Min    time.Duration  `json:"min"`
+	Max    time.Duration  `json:"max"`
+}
+
+// Snapshot returns the state of h, e.g. for merging it into the
+// histogram of another process.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := HistogramSnapshot{
+		Counts: make(map[int]uint64),
+		Min:    h.min,
+		Max:    h.max,
+	}
+	for idx, count := range h.counts {
+		if count > 0 {
+			s.Counts[idx] = count
+		}
+	}
+	return s
+}
+
+// Merge adds all values recorded in s to h.
+func (h *Histogram) Merge(s HistogramSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var total uint64
+	for idx, count := range s.Counts {
+		if idx < 0 || idx >= len(h.counts) {
+			continue
+		}
+		h.counts[idx] += count
+		total += count
+	}
+	if total == 0 {
+		return
+	}
+	h.total += total
+	if s.Min < h.min {
+		h.min = s.Min
+	}
+	if s.Max > h.max {
+		h.max = s.Max
+	}
+}
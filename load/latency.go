@@ -0,0 +1,343 @@
+package load
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/robustclient"
+)
+
+// UnknownNode is used as node label when the node is not known, e.g.
+// for messages which were sent by a different process.
+const UnknownNode = "unknown"
+
+func nodeLabel(server string) string {
+	if server == "" {
+		return UnknownNode
+	}
+	return server
+}
+
+// messageKey identifies a benchmark message across all senders.
+type messageKey struct {
+	sender int
+	seq    uint64
+}
+
+// sendRecord describes when and where a message was sent.
+type sendRecord struct {
+	sent time.Time
+	// server is the server the message was posted to.
+	server string
+}
+
+// sendTimeExpiry is how long a send record is kept. Messages which
+// were not received within sendTimeExpiry are considered lost, so that
+// lost messages do not grow the records without bound.
+const sendTimeExpiry = 1 * time.Minute
+
+// sendTimes records when each message was sent by a sender of this
+// Runner. The receiver correlates received messages with these
+// records, so that latency is measured using the monotonic clock of a
+// single process instead of comparing wall clock timestamps.
+//
+// A nil *sendTimes records nothing, which is used by Runners that do not
+// run the receiving session.
+type sendTimes struct {
+	mu    sync.Mutex
+	times map[messageKey]sendRecord
+	// order contains the keys of times in the order they were recorded,
+	// see expireLocked.
+	order []orderedKey
+	// expired counts the expired records by the second (Unix time) in
+	// which their message was sent.
+	expired map[int64]uint64
+}
+
+type orderedKey struct {
+	key  messageKey
+	sent time.Time
+}
+
+func newSendTimes() *sendTimes {
+	return &sendTimes{
+		times:   make(map[messageKey]sendRecord),
+		expired: make(map[int64]uint64),
+	}
+}
+
+func (s *sendTimes) record(sender int, seq uint64, t time.Time, server string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := messageKey{sender, seq}
+	s.times[key] = sendRecord{sent: t, server: server}
+	s.order = append(s.order, orderedKey{key: key, sent: t})
+	s.expireLocked(t)
+}
+
+// expireLocked removes the records which are older than sendTimeExpiry
+// at now and counts them as expired.
+func (s *sendTimes) expireLocked(now time.Time) {
+	for len(s.order) > 0 && now.Sub(s.order[0].sent) > sendTimeExpiry {
+		key := s.order[0].key
+		s.order = s.order[1:]
+		// The record is gone if the message was received or could not
+		// be sent.
+		if r, ok := s.times[key]; ok {
+			delete(s.times, key)
+			s.expired[r.sent.Unix()]++
+		}
+	}
+}
+
+// setServer corrects the server a message was posted to, in case the
+// request was not sent to the server passed to record (e.g. because
+// that server was backed off). Messages which were already received
+// are not affected.
+func (s *sendTimes) setServer(sender int, seq uint64, server string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := messageKey{sender, seq}
+	if r, ok := s.times[key]; ok {
+		r.server = server
+		s.times[key] = r
+	}
+}
+
+// forget removes the record of a message which could not be sent.
+func (s *sendTimes) forget(sender int, seq uint64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.times, messageKey{sender, seq})
+}
+
+// take returns (and removes) the send time of a message. ok is false
+// if the message was not sent by this Runner, was already taken (i.e. is
+// a duplicate) or its record expired.
+func (s *sendTimes) take(sender int, seq uint64) (r sendRecord, ok bool) {
+	if s == nil {
+		return sendRecord{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := messageKey{sender, seq}
+	r, ok = s.times[key]
+	delete(s.times, key)
+	return r, ok
+}
+
+// countBetween returns the number of messages which were sent within
+// [from, to) and not received (yet). Expired records are counted with
+// a precision of one second.
+func (s *sendTimes) countBetween(from, to time.Time) uint64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count uint64
+	for _, r := range s.times {
+		if !r.sent.Before(from) && r.sent.Before(to) {
+			count++
+		}
+	}
+	for sec, n := range s.expired {
+		if t := time.Unix(sec, 0); !t.Before(from.Truncate(time.Second)) && t.Before(to) {
+			count += n
+		}
+	}
+	return count
+}
+
+// now returns the current time according to Options.ClockOffset.
+// Timestamps which are compared across processes must use now.
+func (r *Runner) now() time.Time {
+	return time.Now().Add(r.opts.ClockOffset)
+}
+
+// messageLatencyOf returns the latency of the message described by
+// payload, which was received at received, and the server it was
+// posted to (empty if unknown).
+func (r *Runner) messageLatencyOf(payload benchPayload, received time.Time) (time.Duration, string) {
+	if rec, ok := r.sendTimes.take(payload.Sender, payload.Seq); ok {
+		return received.Sub(rec.sent), rec.server
+	}
+	// The message was sent by a different process (possibly on a
+	// different host), so only the embedded timestamp is available.
+	return received.Add(r.opts.ClockOffset).Sub(time.Unix(0, payload.Sent)), ""
+}
+
+func (r *Runner) observeLatency(latency time.Duration) {
+	r.metrics.latency.Observe(latency.Seconds())
+	r.latency.Record(latency)
+	r.secondLatency.Record(latency)
+	r.churner.observeLatency(latency)
+}
+
+type nodePair struct {
+	post, receive string
+}
+
+// NodeLatency is the latency of the messages which were posted to
+// PostServer and received from ReceiveServer.
+type NodeLatency struct {
+	PostServer    string
+	ReceiveServer string
+	Latency       *Histogram
+}
+
+// PostLatency is the duration of the PostMessage requests which were
+// sent to Server and handled by Handler.
+type PostLatency struct {
+	Server  string
+	Handler string
+	Latency *Histogram
+}
+
+// nodeLatencyRecorder records latencies per node in-process, so that
+// reports can include a per-node breakdown.
+type nodeLatencyRecorder struct {
+	mu      sync.Mutex
+	message map[nodePair]*Histogram
+	post    map[robustclient.Served]*Histogram
+}
+
+func newNodeLatencyRecorder() *nodeLatencyRecorder {
+	return &nodeLatencyRecorder{
+		message: make(map[nodePair]*Histogram),
+		post:    make(map[robustclient.Served]*Histogram),
+	}
+}
+
+func (r *nodeLatencyRecorder) messageHistogram(pair nodePair) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.message[pair]
+	if !ok {
+		h = NewHistogram()
+		r.message[pair] = h
+	}
+	return h
+}
+
+func (r *nodeLatencyRecorder) postHistogram(served robustclient.Served) *Histogram {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.post[served]
+	if !ok {
+		h = NewHistogram()
+		r.post[served] = h
+	}
+	return h
+}
+
+// observeNodeLatency records the latency of a message which was posted
+// to postServer and received from receiveServer.
+func (r *Runner) observeNodeLatency(postServer, receiveServer string, latency time.Duration) {
+	pair := nodePair{nodeLabel(postServer), nodeLabel(receiveServer)}
+	r.metrics.latencyByNode.WithLabelValues(pair.post, pair.receive).Observe(latency.Seconds())
+	r.nodeLatencies.messageHistogram(pair).Record(latency)
+}
+
+// observePostLatency records the duration of a PostMessage request.
+func (r *Runner) observePostLatency(served robustclient.Served, d time.Duration) {
+	r.metrics.postLatency.WithLabelValues(served.Server, served.Handler()).Observe(d.Seconds())
+	r.nodeLatencies.postHistogram(served).Record(d)
+}
+
+// NodeLatencies returns the message latencies and the PostMessage
+// durations by node, sorted by node.
+func (r *Runner) NodeLatencies() ([]NodeLatency, []PostLatency) {
+	nl := r.nodeLatencies
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	messages := make([]NodeLatency, 0, len(nl.message))
+	for pair, h := range nl.message {
+		messages = append(messages, NodeLatency{
+			PostServer:    pair.post,
+			ReceiveServer: pair.receive,
+			Latency:       h,
+		})
+	}
+	sort.Slice(messages, func(i, j int) bool {
+		if messages[i].PostServer != messages[j].PostServer {
+			return messages[i].PostServer < messages[j].PostServer
+		}
+		return messages[i].ReceiveServer < messages[j].ReceiveServer
+	})
+	posts := make([]PostLatency, 0, len(nl.post))
+	for served, h := range nl.post {
+		posts = append(posts, PostLatency{
+			Server:  served.Server,
+			Handler: served.Handler(),
+			Latency: h,
+		})
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if posts[i].Server != posts[j].Server {
+			return posts[i].Server < posts[j].Server
+		}
+		return posts[i].Handler < posts[j].Handler
+	})
+	return messages, posts
+}
+
+// NodeLatencySnapshot is the state of a NodeLatency, e.g. for merging
+// it into the Runner of another process.
+type NodeLatencySnapshot struct {
+	PostServer    string            `json:"post_server"`
+	ReceiveServer string            `json:"receive_server"`
+	Latency       HistogramSnapshot `json:"latency"`
+}
+
+// PostLatencySnapshot is the state of a PostLatency, e.g. for merging
+// it into the Runner of another process.
+type PostLatencySnapshot struct {
+	Served  robustclient.Served `json:"served"`
+	Latency HistogramSnapshot   `json:"latency"`
+}
+
+// NodeLatencySnapshots returns the state of the message latencies and
+// PostMessage durations by node (see NodeLatencies).
+func (r *Runner) NodeLatencySnapshots() ([]NodeLatencySnapshot, []PostLatencySnapshot) {
+	nl := r.nodeLatencies
+	nl.mu.Lock()
+	defer nl.mu.Unlock()
+	messages := make([]NodeLatencySnapshot, 0, len(nl.message))
+	for pair, h := range nl.message {
+		messages = append(messages, NodeLatencySnapshot{
+			PostServer:    pair.post,
+			ReceiveServer: pair.receive,
+			Latency:       h.Snapshot(),
+		})
+	}
+	posts := make([]PostLatencySnapshot, 0, len(nl.post))
+	for served, h := range nl.post {
+		posts = append(posts, PostLatencySnapshot{
+			Served:  served,
+			Latency: h.Snapshot(),
+		})
+	}
+	return messages, posts
+}
+
+// MergeNodeLatencies adds the per-node latencies of another process of
+// a distributed run (see NodeLatencySnapshots).
+func (r *Runner) MergeNodeLatencies(messages []NodeLatencySnapshot, posts []PostLatencySnapshot) {
+	for _, m := range messages {
+		r.nodeLatencies.messageHistogram(nodePair{m.PostServer, m.ReceiveServer}).Merge(m.Latency)
+	}
+	for _, p := range posts {
+		r.nodeLatencies.postHistogram(p.Served).Merge(p.Latency)
+	}
+}
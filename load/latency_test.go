@@ -0,0 +1,49 @@
+package load
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSendTimesExpiry(t *testing.T) {
+	s := newSendTimes()
+	start := time.Unix(1000, 0)
+	s.record(1, 1, start, "a")
+	s.record(1, 2, start.Add(1*time.Second), "a")
+	s.record(2, 1, start.Add(2*time.Second), "b")
+	if _, ok := s.take(1, 2); !ok {
+		t.Fatalf("take(1, 2): record not found")
+	}
+
+	// Recording a message after sendTimeExpiry expires the unreceived
+	// messages, but they are still counted as in flight.
+	s.record(2, 2, start.Add(sendTimeExpiry+3*time.Second), "b")
+	if got, want := len(s.times), 1; got != want {
+		t.Errorf("records after expiry: got %d, want %d", got, want)
+	}
+	if _, ok := s.take(1, 1); ok {
+		t.Errorf("take(1, 1): expired record unexpectedly found")
+	}
+	for _, tt := range []struct {
+		from, to time.Time
+		want     uint64
+	}{
+		{start, start.Add(1 * time.Second), 1},
+		{start, start.Add(3 * time.Second), 2},
+		{start.Add(1 * time.Second), start.Add(3 * time.Second), 1},
+		{start, start.Add(time.Hour), 3},
+	} {
+		if got := s.countBetween(tt.from, tt.to); got != tt.want {
+			t.Errorf("countBetween(%v, %v): got %d, want %d", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	var none *sendTimes
+	none.record(1, 1, start, "a")
+	if _, ok := none.take(1, 1); ok {
+		t.Errorf("nil sendTimes: take unexpectedly found a record")
+	}
+	if got := none.countBetween(start, start.Add(time.Hour)); got != 0 {
+		t.Errorf("nil sendTimes: countBetween: got %d, want 0", got)
+	}
+}
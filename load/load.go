@@ -0,0 +1,792 @@
+// Package load generates benchmark load on a RobustIRC network: it sets
+// up sessions which join a number of channels, sends messages at a
+// configurable rate (or replays a trace) and measures the throughput
+// and latency of the network until the throughput converged.
+//
+// All state is kept per Runner, including the Prometheus metrics (see
+// Runner.Registry), so that multiple Runners can be used in one
+// process.
+package load
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robustirc/benchmark/internal/robustclient"
+	"github.com/robustirc/benchmark/internal/trace"
+)
+
+// Options configure a Runner. Zero values select the documented
+// defaults.
+type Options struct {
+	// Servers are the host:port addresses of the RobustIRC network.
+	Servers []string
+
+	// Sessions is the number of sessions of the benchmark. Session 0
+	// receives all messages, all others send.
+	Sessions int
+
+	// First and Count are the range of sessions run by this Runner,
+	// e.g. [0, Sessions) to run all of them. A run can be distributed
+	// across processes by running a different range in each process.
+	First, Count int
+
+	// Channels is the number of channels the sessions join. Defaults to
+	// Sessions / 50, but at least 1.
+	Channels int
+
+	// Prefix is used for nicknames and channel names. Runners which use
+	// the same network at the same time need different prefixes.
+	// Defaults to “bench”.
+	Prefix string
+
+	// Rate is the number of messages/s to (try to) send, across all
+	// sending sessions of this Runner. See also Runner.SetRate.
+	Rate float64
+
+	// UntilConverged makes Run return once the number of received
+	// messages/s converged, but not before MinDuration. Otherwise, Run
+	// sends until Runner.Stop is called.
+	UntilConverged bool
+	MinDuration    time.Duration
+
+	// DrainTimeout is how long Run waits for in-flight messages after
+	// sending stopped.
+	DrainTimeout time.Duration
+
+	// SetupTimeout is how long to wait for all sessions to be set up.
+	// Defaults to 5 minutes.
+	SetupTimeout time.Duration
+
+	// Reconnect makes sessions which failed be recreated (with
+	// exponential backoff), up to MaxReconnects times.
+	Reconnect     bool
+	MaxReconnects int
+
+	// MaxDeadSessions is the fraction of sending sessions which may die
+	// before the run fails.
+	MaxDeadSessions float64
+
+	// ChurnRate is the fraction of sending sessions which are deleted and
+	// recreated per second, starting ChurnDelay after sending started.
+	ChurnRate  float64
+	ChurnDelay time.Duration
+
+	// ServerSelection is one of “failover” (default), “round-robin”,
+	// “random” or “pinned”, see robustclient.Options.
+	ServerSelection string
+
+	Transport robustclient.TransportOptions
+
+	// SharedClient makes all sessions share one HTTP client (and hence
+	// one connection pool).
+	SharedClient bool
+
+	// LatencyBuckets are the bucket bounds (in seconds) of the latency
+	// histogram metrics. Defaults to prometheus.DefBuckets, unless
+	// NativeHistogramBucketFactor is set.
+	LatencyBuckets []float64
+
+	// NativeHistogramBucketFactor, if greater than 1, makes the latency
+	// histogram metrics Prometheus native histograms (in addition to
+	// LatencyBuckets, if any) whose buckets grow by at most this factor,
+	// see prometheus.HistogramOpts.
+	NativeHistogramBucketFactor float64
+
+	// ClockOffset is the offset of the local clock to the clock of the
+	// other processes of a distributed run.
+	ClockOffset time.Duration
+
+	// Trace, if not empty, is replayed at TraceSpeed (defaults to 1)
+	// instead of sending Rate messages/s. Run returns once the trace
+	// was replayed.
+	Trace      []trace.Event
+	TraceSpeed float64
+
+	// Counters, if set, replaces the counters of this Runner’s sessions
+	// when measuring, e.g. to measure the sessions of remote processes.
+	Counters func() (sent, received uint64, err error)
+
+	// SessionCreated is called whenever a session was created.
+	SessionCreated func(served robustclient.Served)
+
+	// SetupFinished is called once all sessions were set up.
+	SetupFinished func(d time.Duration)
+
+	// SecondRecorded is called once per second while sending. min and
+	// max are the lowest and highest number of messages received per
+	// second within the last 10 seconds.
+	SecondRecorded func(s Second, min, max uint64)
+
+	// ConvergenceChecked is called whenever convergence was checked
+	// (every 10 seconds once MinDuration passed).
+	ConvergenceChecked func(c Convergence)
+
+	// Hold, if set, prevents Run from returning (despite convergence)
+	// while it returns true, e.g. while faults are still scheduled.
+	Hold func() bool
+}
+
+// Runner states, see Status.
+const (
+	StateSettingUp = "setting up"
+	StateSending   = "sending"
+	StateDraining  = "draining"
+	StateFinished  = "finished"
+)
+
+// ErrNotSending is returned for requests which can only be served while
+// the Runner is sending.
+var ErrNotSending = errors.New("the run is not sending")
+
+// ErrReplaying is returned for requests which conflict with replaying a
+// trace, where the rate and sessions are dictated by the trace.
+var ErrReplaying = errors.New("not supported while replaying a trace")
+
+// MaxRate is the highest supported rate in messages/s. Tokens are
+// supplied by a time.Ticker, and timers cannot fire reliably more often
+// than every microsecond anyway.
+const MaxRate = 1e6
+
+// CheckRate returns an error unless rate is a valid Options.Rate, i.e.
+// positive and at most MaxRate.
+func CheckRate(rate float64) error {
+	if !(rate > 0 && rate <= MaxRate) {
+		return fmt.Errorf("rate must be positive and at most %g msg/s, got %v", MaxRate, rate)
+	}
+	return nil
+}
+
+// Second is the measurement of one second.
+type Second struct {
+	Time     time.Time `json:"time"`
+	Sent     uint64    `json:"sent"`
+	Received uint64    `json:"received"`
+
+	// LatencyP99 and LatencyMax are the latencies (in ms) of the
+	// messages received within this second.
+	LatencyP99 float64 `json:"latency_p99_ms,omitempty"`
+	LatencyMax float64 `json:"latency_max_ms,omitempty"`
+}
+
+// Convergence describes the received messages/s within the last 10s.
+// The throughput converged once the spread is below 10% of the maximum.
+type Convergence struct {
+	Converged bool    `json:"converged"`
+	Min       uint64  `json:"min"`
+	Max       uint64  `json:"max"`
+	Spread    uint64  `json:"spread"`
+	Ratio     float64 `json:"ratio"`
+}
+
+// Stats are the cumulative counters of a Runner.
+type Stats struct {
+	Sent           uint64
+	Received       uint64
+	SessionsActive int64
+	SessionErrors  uint64
+	RequestErrors  uint64
+}
+
+// stats are updated atomically by the sessions.
+type stats struct {
+	sent           uint64
+	received       uint64
+	sessionsActive int64
+	sessionErrors  uint64
+	requestErrors  uint64
+}
+
+// Status describes what a Runner is doing.
+type Status struct {
+	State string
+	// Started is when sending started.
+	Started time.Time
+	Rate    float64
+	// Sessions is the number of sending sessions.
+	Sessions     int
+	DeadSessions int
+}
+
+// Runner runs (a range of the sessions of) a benchmark.
+type Runner struct {
+	opts         Options
+	registry     *prometheus.Registry
+	metrics      *metrics
+	sharedClient *http.Client
+
+	stats         stats
+	accounting    *accounting
+	latency       *Histogram
+	secondLatency *Histogram
+	nodeLatencies *nodeLatencyRecorder
+	sendTimes     *sendTimes
+	churner       *churner
+
+	// group is set up by Setup and afterwards only used by the
+	// goroutine calling Run.
+	group    *sessionGroup
+	requests chan request
+
+	mu          sync.Mutex
+	status      Status
+	convergence Convergence
+	stopped     chan struct{} // closed when Run stops serving requests
+}
+
+// New returns a Runner. It does not create any sessions yet, see Setup.
+func New(opts Options) (*Runner, error) {
+	if opts.Sessions < 2 {
+		return nil, fmt.Errorf("at least 2 sessions are required (1 receiving, 1 sending), got %d", opts.Sessions)
+	}
+	if opts.First < 0 || opts.Count < 0 || opts.First+opts.Count > opts.Sessions {
+		return nil, fmt.Errorf("sessions [%d, %d) out of range [0, %d)", opts.First, opts.First+opts.Count, opts.Sessions)
+	}
+	if opts.Count > 0 && len(opts.Servers) == 0 {
+		return nil, fmt.Errorf("no servers specified")
+	}
+	switch opts.ServerSelection {
+	case "", "failover", "round-robin", "random", "pinned":
+	default:
+		return nil, fmt.Errorf("unknown server selection %q, expected failover, round-robin, random or pinned", opts.ServerSelection)
+	}
+	if opts.Channels == 0 {
+		opts.Channels = opts.Sessions / 50
+	}
+	if opts.Channels < 1 {
+		opts.Channels = 1
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "bench"
+	}
+	if opts.SetupTimeout == 0 {
+		opts.SetupTimeout = 5 * time.Minute
+	}
+	if opts.LatencyBuckets == nil && opts.NativeHistogramBucketFactor <= 1 {
+		opts.LatencyBuckets = prometheus.DefBuckets
+	}
+	m := newMetrics(opts.LatencyBuckets, opts.NativeHistogramBucketFactor)
+	r := &Runner{
+		opts:          opts,
+		registry:      prometheus.NewRegistry(),
+		metrics:       m,
+		accounting:    newAccounting(m),
+		latency:       NewHistogram(),
+		secondLatency: NewHistogram(),
+		nodeLatencies: newNodeLatencyRecorder(),
+		churner:       newChurner(opts.Sessions, opts.First, opts.Count),
+		requests:      make(chan request),
+		status: Status{
+			State: StateSettingUp,
+			Rate:  opts.Rate,
+		},
+		stopped: make(chan struct{}),
+	}
+	m.register(r.registry)
+	// Only the Runner which runs the receiving session takes the
+	// records, see messageLatencyOf.
+	if opts.First == 0 && opts.Count > 0 {
+		r.sendTimes = newSendTimes()
+	}
+	if opts.SharedClient {
+		r.sharedClient = robustclient.NewClient(opts.Transport)
+	}
+	return r, nil
+}
+
+// Registry returns the registry of the Runner’s metrics.
+func (r *Runner) Registry() *prometheus.Registry {
+	return r.registry
+}
+
+// Setup creates the sessions of the Runner and returns once all of them
+// joined their channels. Run calls Setup if it was not called before.
+func (r *Runner) Setup(ctx context.Context) error {
+	if r.group != nil {
+		return nil
+	}
+	if r.opts.Count == 0 {
+		r.group = &sessionGroup{runner: r, first: r.opts.First}
+		return nil
+	}
+	log.Printf("Joining %d channels with %d connections\n", r.opts.Channels, r.opts.Count)
+	g, err := r.startSessions(ctx, r.opts.First, r.opts.Count)
+	if err != nil {
+		return err
+	}
+	r.group = g
+	return nil
+}
+
+// RecordSetupDuration records how long setting up the sessions took.
+// It is called by Setup, and needs to be called by callers which set up
+// sessions elsewhere (see Options.Counters).
+func (r *Runner) RecordSetupDuration(d time.Duration) {
+	r.metrics.setupDuration.Set(d.Seconds())
+	if r.opts.SetupFinished != nil {
+		r.opts.SetupFinished(d)
+	}
+}
+
+// tokenInterval returns the interval in which tokens need to be
+// supplied to send rate messages/s. time.NewTicker panics for
+// intervals which are not positive, so the interval is at least 1ns.
+func tokenInterval(rate float64) time.Duration {
+	interval := time.Duration(float64(time.Second) / rate)
+	if interval < 1 {
+		interval = 1
+	}
+	return interval
+}
+
+// loop is the state of Run which requests can change.
+type loop struct {
+	group *sessionGroup
+	rate  float64
+	// ticker unblocks sessions (“supplies a token” in the typical token
+	// bucket terminology used in network throttling) often enough that
+	// they can send rate messages/s. It is nil while no session sends.
+	ticker *time.Ticker
+	replay *replay
+	// stopping is set by Stop.
+	stopping bool
+}
+
+func (l *loop) tokens() <-chan time.Time {
+	if l.ticker == nil {
+		return nil
+	}
+	return l.ticker.C
+}
+
+func (l *loop) setRate(rate float64) {
+	if l.ticker != nil {
+		l.ticker.Stop()
+		l.ticker = nil
+	}
+	l.rate = rate
+	if l.group.sending() > 0 && l.replay == nil {
+		l.ticker = time.NewTicker(tokenInterval(rate))
+	}
+}
+
+type request struct {
+	fn   func(*loop) error
+	done chan error
+}
+
+// Run sends messages (or replays Options.Trace) until the throughput
+// converged (see Options.UntilConverged), the trace was replayed or
+// Stop is called. It then waits Options.DrainTimeout for in-flight
+// messages. If ctx is done, Run stops sending and returns ctx.Err()
+// without waiting. The results measured so far remain available.
+//
+// The sessions are kept after Run returned, so that the receiving
+// session still receives the messages of other processes, see Shutdown.
+func (r *Runner) Run(ctx context.Context) error {
+	if err := r.Setup(ctx); err != nil {
+		return err
+	}
+	g := r.group
+	started := time.Now()
+	l := &loop{group: g}
+	r.mu.Lock()
+	rate := r.status.Rate
+	r.mu.Unlock()
+	if len(r.opts.Trace) > 0 {
+		l.replay = r.startReplay(g)
+		defer close(l.replay.stop)
+	} else if r.opts.Count > 0 {
+		log.Printf("Starting to send")
+	}
+	l.setRate(rate)
+	defer func() {
+		if l.ticker != nil {
+			l.ticker.Stop()
+		}
+	}()
+	r.begin(l, started)
+	defer r.end(StateFinished)
+
+	// due is nil unless a trace is replayed.
+	var due <-chan *trace.Event
+	if l.replay != nil {
+		due = l.replay.due
+	}
+	every1s := time.NewTicker(1 * time.Second)
+	defer every1s.Stop()
+	every10s := time.NewTicker(10 * time.Second)
+	defer every10s.Stop()
+	m := r.newMeasurement()
+	for {
+		if l.stopping {
+			if l.replay != nil {
+				l.replay.logReport("Replay stopped as requested")
+			} else {
+				log.Printf("Stopped as requested")
+			}
+			return r.drain(ctx)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-every1s.C:
+			if r.opts.ChurnRate > 0 && time.Since(started) >= r.opts.ChurnDelay {
+				r.churner.tick(r.opts.ChurnRate)
+			}
+			if err := m.record(); err != nil {
+				return err
+			}
+
+		case <-every10s.C:
+			if !r.opts.UntilConverged || l.replay != nil || time.Since(started) <= r.opts.MinDuration {
+				continue
+			}
+			if r.opts.Hold != nil && r.opts.Hold() {
+				continue
+			}
+			if m.converged() {
+				return r.drain(ctx)
+			}
+
+		case idx := <-g.dead:
+			if err := g.handleDead(idx); err != nil {
+				return err
+			}
+			r.update(l)
+
+		case req := <-r.requests:
+			req.done <- req.fn(l)
+			r.update(l)
+
+		case ev, ok := <-due:
+			if !ok {
+				l.replay.logReport("Trace replayed")
+				return r.drain(ctx)
+			}
+			l.replay.send(r, g, ev)
+
+		case <-l.tokens():
+			select {
+			case g.tokens <- token{}:
+			case idx := <-g.dead:
+				// Once all sending sessions died, nobody takes the
+				// token.
+				if err := g.handleDead(idx); err != nil {
+					return err
+				}
+				r.update(l)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// drain waits Options.DrainTimeout for in-flight messages.
+func (r *Runner) drain(ctx context.Context) error {
+	r.end(StateDraining)
+	if r.opts.DrainTimeout <= 0 {
+		return nil
+	}
+	log.Printf("Waiting %v for in-flight messages", r.opts.DrainTimeout)
+	select {
+	case <-time.After(r.opts.DrainTimeout):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Runner) begin(l *loop, started time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status.State = StateSending
+	r.status.Started = started
+	r.updateLocked(l)
+}
+
+func (r *Runner) update(l *loop) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.updateLocked(l)
+}
+
+func (r *Runner) updateLocked(l *loop) {
+	r.status.Rate = l.rate
+	r.status.Sessions = l.group.sending()
+	r.status.DeadSessions = l.group.deadSessions
+}
+
+// end marks that Run stopped serving requests.
+func (r *Runner) end(state string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status.State == StateSending {
+		close(r.stopped)
+	}
+	r.status.State = state
+}
+
+// do runs fn in the goroutine calling Run.
+func (r *Runner) do(fn func(*loop) error) error {
+	r.mu.Lock()
+	sending := r.status.State == StateSending
+	r.mu.Unlock()
+	if !sending {
+		return ErrNotSending
+	}
+	req := request{fn: fn, done: make(chan error, 1)}
+	select {
+	case r.requests <- req:
+		return <-req.done
+	case <-r.stopped:
+		return ErrNotSending
+	}
+}
+
+// SetRate changes the number of messages/s to send, see CheckRate.
+// Before Run, it changes Options.Rate.
+func (r *Runner) SetRate(rate float64) error {
+	if err := CheckRate(rate); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.status.State == StateSettingUp {
+		r.status.Rate = rate
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+	return r.do(func(l *loop) error {
+		if l.replay != nil {
+			return ErrReplaying
+		}
+		l.setRate(rate)
+		return nil
+	})
+}
+
+// AddSessions starts n more sending sessions while sending.
+func (r *Runner) AddSessions(n int) error {
+	if n < 1 {
+		return fmt.Errorf("the number of sessions must be positive, got %d", n)
+	}
+	return r.do(func(l *loop) error {
+		if l.replay != nil {
+			return ErrReplaying
+		}
+		sending := l.group.sending()
+		l.group.addSessions(n)
+		if sending == 0 {
+			l.setRate(l.rate)
+		}
+		return nil
+	})
+}
+
+// RemoveSessions removes up to n sending sessions while sending (at
+// least one is kept) and returns the number of removed sessions.
+func (r *Runner) RemoveSessions(n int) (int, error) {
+	if n < 1 {
+		return 0, fmt.Errorf("the number of sessions must be positive, got %d", n)
+	}
+	var removed int
+	err := r.do(func(l *loop) error {
+		if l.replay != nil {
+			return ErrReplaying
+		}
+		removed = l.group.removeSessions(n)
+		return nil
+	})
+	return removed, err
+}
+
+// Stop makes Run stop sending, wait for in-flight messages and return.
+func (r *Runner) Stop() error {
+	return r.do(func(l *loop) error {
+		l.stopping = true
+		return nil
+	})
+}
+
+// Close deletes all sessions (with a QUIT message) in the background.
+// It must not be called while Run is running.
+func (r *Runner) Close() {
+	if r.group != nil {
+		r.group.close()
+	}
+}
+
+// Shutdown deletes all sessions like Close and waits until they were
+// deleted or ctx is done.
+func (r *Runner) Shutdown(ctx context.Context) error {
+	if r.group == nil {
+		return nil
+	}
+	r.group.close()
+	return r.group.wait(ctx)
+}
+
+// Status returns what the Runner is doing.
+func (r *Runner) Status() Status {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// Stats returns the cumulative counters of the Runner.
+func (r *Runner) Stats() Stats {
+	return Stats{
+		Sent:           atomic.LoadUint64(&r.stats.sent),
+		Received:       atomic.LoadUint64(&r.stats.received),
+		SessionsActive: atomic.LoadInt64(&r.stats.sessionsActive),
+		SessionErrors:  atomic.LoadUint64(&r.stats.sessionErrors),
+		RequestErrors:  atomic.LoadUint64(&r.stats.requestErrors),
+	}
+}
+
+// Convergence returns the result of the most recent convergence check.
+func (r *Runner) Convergence() Convergence {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.convergence
+}
+
+// Latency returns the histogram of all message latencies.
+func (r *Runner) Latency() *Histogram {
+	return r.latency
+}
+
+// Accounting returns the message accounting by sender.
+func (r *Runner) Accounting() map[int]AccountingSummary {
+	return r.accounting.perSender()
+}
+
+// AccountingTotal returns the message accounting of all senders.
+func (r *Runner) AccountingTotal() AccountingSummary {
+	return r.accounting.total()
+}
+
+// Merge adds the message accounting and latencies of another process
+// of a distributed run (see Accounting and Latency). Per-node latencies
+// are merged separately, see MergeNodeLatencies.
+func (r *Runner) Merge(accounting map[int]AccountingSummary, latency HistogramSnapshot) {
+	r.accounting.merge(accounting)
+	r.latency.Merge(latency)
+}
+
+// InFlight returns the number of messages which were sent within
+// [from, to) by this Runner, but not received (yet). It is 0 unless the
+// Runner runs the receiving session (session 0).
+func (r *Runner) InFlight(from, to time.Time) uint64 {
+	return r.sendTimes.countBetween(from, to)
+}
+
+// LogResults logs the message accounting and, with Options.ChurnRate,
+// the latency before and during churn. In-flight messages must have
+// been drained.
+func (r *Runner) LogResults() {
+	r.accounting.logReport()
+	if r.opts.ChurnRate > 0 {
+		r.churner.logReport()
+	}
+}
+
+// measurement turns the cumulative counters into per-second values.
+type measurement struct {
+	r            *Runner
+	window       *window
+	lastSent     uint64
+	lastReceived uint64
+}
+
+func (r *Runner) newMeasurement() *measurement {
+	return &measurement{
+		r:      r,
+		window: newWindow(convergenceWindow),
+	}
+}
+
+// record must be called once per second.
+func (m *measurement) record() error {
+	r := m.r
+	var sent, received uint64
+	if r.opts.Counters != nil {
+		var err error
+		if sent, received, err = r.opts.Counters(); err != nil {
+			return err
+		}
+	} else {
+		s := r.Stats()
+		sent, received = s.Sent, s.Received
+	}
+	m.window.add(received - m.lastReceived)
+	min := m.window.min()
+	max := m.window.max()
+
+	r.metrics.sent.Add(float64(sent - m.lastSent))
+	r.metrics.received.Add(float64(received - m.lastReceived))
+	r.metrics.spread.Set(float64(max - min))
+
+	sample := Second{
+		Time:     time.Now(),
+		Sent:     sent - m.lastSent,
+		Received: received - m.lastReceived,
+	}
+	if r.secondLatency.Count() > 0 {
+		sample.LatencyP99 = r.secondLatency.Quantile(0.99).Seconds() * 1000
+		sample.LatencyMax = r.secondLatency.Quantile(1).Seconds() * 1000
+		r.secondLatency.Reset()
+	}
+	if r.opts.SecondRecorded != nil {
+		r.opts.SecondRecorded(sample, min, max)
+	}
+
+	m.lastSent = sent
+	m.lastReceived = received
+	return nil
+}
+
+// converged returns whether the received messages/s within the last
+// 10s have converged.
+func (m *measurement) converged() bool {
+	min := m.window.min()
+	max := m.window.max()
+	spread := max - min
+
+	c := Convergence{
+		Min:    min,
+		Max:    max,
+		Spread: spread,
+	}
+	// Without any received messages (e.g. during an outage), the ratio
+	// would be NaN, which cannot be serialized as JSON.
+	if max > 0 {
+		c.Ratio = float64(spread) / float64(max)
+		c.Converged = c.Ratio < 0.1
+	}
+	m.r.mu.Lock()
+	m.r.convergence = c
+	m.r.mu.Unlock()
+	if m.r.opts.ConvergenceChecked != nil {
+		m.r.opts.ConvergenceChecked(c)
+	}
+	if c.Converged {
+		log.Printf("converged! spread is < 10%%")
+	}
+
+	// This approach does not work well: it just permanently reduces the qps, without any clear improvement in spread
+	// targetQps := (1 - (spread / max)) * max
+	// log.Printf("re-adjusting: targetQps = %v", targetQps)
+	// tokensTicker = time.Tick(time.Duration(1e6/targetQps) * time.Microsecond)
+	return c.Converged
+}
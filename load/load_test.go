@@ -0,0 +1,230 @@
+package load_test
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/fakerobustirc"
+	"github.com/robustirc/benchmark/internal/robustclient"
+	"github.com/robustirc/benchmark/load"
+	"golang.org/x/sync/errgroup"
+)
+
+// TestConcurrentRunners verifies that Runners in one process do not
+// share state.
+func TestConcurrentRunners(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in -short mode")
+	}
+
+	n := fakerobustirc.NewNetwork(3, fakerobustirc.Options{})
+	defer n.Close()
+
+	runners := make([]*load.Runner, 2)
+	for idx, prefix := range []string{"a", "b"} {
+		r, err := load.New(load.Options{
+			Servers:        n.Servers(),
+			Sessions:       3,
+			Count:          3,
+			Prefix:         prefix,
+			Rate:           100,
+			UntilConverged: true,
+			DrainTimeout:   1 * time.Second,
+			SetupTimeout:   30 * time.Second,
+			Transport: robustclient.TransportOptions{
+				TLSConfig: &tls.Config{RootCAs: n.CertPool()},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		runners[idx] = r
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	var g errgroup.Group
+	for _, r := range runners {
+		r := r // capture range variable
+		g.Go(func() error { return r.Run(ctx) })
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	for idx, r := range runners {
+		total := r.AccountingTotal()
+		if total.Received == 0 {
+			t.Fatalf("runner %d: no messages received: %+v", idx, total)
+		}
+		if total.Lost != 0 || total.Duplicated != 0 {
+			t.Errorf("runner %d: messages lost or duplicated: %+v", idx, total)
+		}
+		// Each Runner only receives its own messages.
+		if total.Received > total.Sent {
+			t.Errorf("runner %d: received more messages than sent: %+v", idx, total)
+		}
+		if r.Latency().Count() == 0 {
+			t.Errorf("runner %d: no latency samples", idx)
+		}
+		if err := r.Shutdown(ctx); err != nil {
+			t.Fatalf("runner %d: Shutdown: %v", idx, err)
+		}
+		if got := r.Stats().SessionsActive; got != 0 {
+			t.Errorf("runner %d: %d sessions active after Shutdown", idx, got)
+		}
+	}
+
+	// Merging per-node latencies, as the coordinator of a distributed
+	// run does, adds up the samples of both Runners.
+	count := func(r *load.Runner) (messages, posts uint64) {
+		nodes, postLatencies := r.NodeLatencies()
+		for _, n := range nodes {
+			messages += n.Latency.Count()
+		}
+		for _, p := range postLatencies {
+			posts += p.Latency.Count()
+		}
+		return messages, posts
+	}
+	messages0, posts0 := count(runners[0])
+	messages1, posts1 := count(runners[1])
+	runners[0].MergeNodeLatencies(runners[1].NodeLatencySnapshots())
+	messages, posts := count(runners[0])
+	if want := messages0 + messages1; messages != want {
+		t.Errorf("merged message latencies: got %d samples, want %d", messages, want)
+	}
+	if want := posts0 + posts1; posts != want {
+		t.Errorf("merged PostMessage durations: got %d samples, want %d", posts, want)
+	}
+}
+
+func TestRunCanceled(t *testing.T) {
+	// A Runner without sessions, which measures counters that stay 0.
+	r, err := load.New(load.Options{
+		Sessions:       2,
+		Rate:           10,
+		UntilConverged: true,
+		Counters: func() (sent, received uint64, err error) {
+			return 0, 0, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if got, want := r.Run(ctx), context.DeadlineExceeded; got != want {
+		t.Fatalf("Run: got %v, want %v", got, want)
+	}
+	if got, want := r.Status().State, load.StateFinished; got != want {
+		t.Errorf("state after Run: got %q, want %q", got, want)
+	}
+}
+
+// TestConvergenceWithoutMessages verifies that a convergence check
+// without any received messages (e.g. during an outage) results in a
+// Convergence which can be serialized, as reports do.
+func TestConvergenceWithoutMessages(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping slow test in -short mode")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	checked := make(chan load.Convergence, 1)
+	r, err := load.New(load.Options{
+		Sessions:       2,
+		Rate:           10,
+		UntilConverged: true,
+		Counters: func() (sent, received uint64, err error) {
+			return 0, 0, nil
+		},
+		ConvergenceChecked: func(c load.Convergence) {
+			select {
+			case checked <- c:
+			default:
+			}
+			cancel()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Run(ctx), context.Canceled; got != want {
+		t.Fatalf("Run: got %v, want %v", got, want)
+	}
+	c := <-checked
+	if c.Converged {
+		t.Errorf("converged without any received messages: %+v", c)
+	}
+	b, err := json.Marshal(struct {
+		Convergence load.Convergence `json:"convergence"`
+	}{c})
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	if got, want := string(b), `{"convergence":{"converged":false,"min":0,"max":0,"spread":0,"ratio":0}}`; got != want {
+		t.Errorf("json.Marshal: got %s, want %s", got, want)
+	}
+}
+
+// TestAllSendersDead verifies that Run fails instead of blocking forever
+// once all sending sessions died, even if MaxDeadSessions tolerates it.
+func TestAllSendersDead(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping end-to-end test in -short mode")
+	}
+
+	n := fakerobustirc.NewNetwork(1, fakerobustirc.Options{})
+	defer n.Close()
+
+	r, err := load.New(load.Options{
+		Servers:         n.Servers(),
+		Sessions:        3,
+		Count:           3,
+		Prefix:          "dead",
+		Rate:            100,
+		MaxDeadSessions: 1,
+		SetupTimeout:    30 * time.Second,
+		Transport: robustclient.TransportOptions{
+			TLSConfig: &tls.Config{RootCAs: n.CertPool()},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	defer r.Shutdown(ctx)
+	if err := r.Setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, nick := range []string{"dead-1", "dead-2"} {
+		if !n.KillSession(nick) {
+			t.Fatalf("KillSession(%q): no such session", nick)
+		}
+	}
+	err = r.Run(ctx)
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("Run: got %v, want an error about the dead sessions", err)
+	}
+	t.Logf("Run: %v", err)
+}
+
+func TestCheckRate(t *testing.T) {
+	for _, rate := range []float64{0.5, 10000, load.MaxRate} {
+		if err := load.CheckRate(rate); err != nil {
+			t.Errorf("CheckRate(%v): %v", rate, err)
+		}
+	}
+	for _, rate := range []float64{0, -1, 2e6, math.NaN(), math.Inf(1)} {
+		if err := load.CheckRate(rate); err == nil {
+			t.Errorf("CheckRate(%v) unexpectedly succeeded", rate)
+		}
+	}
+}
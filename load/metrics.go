@@ -0,0 +1,182 @@
+package load
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// metrics are the Prometheus collectors of a Runner. They are
+// registered with the Runner’s own registry, so that several Runners
+// can be used in one process.
+type metrics struct {
+	sent           prometheus.Counter
+	received       prometheus.Counter
+	spread         prometheus.Gauge
+	sessionsActive prometheus.Gauge
+	sessionErrors  *prometheus.CounterVec
+	setupDuration  prometheus.Gauge
+
+	duplicated prometheus.Counter
+	reordered  prometheus.Counter
+	missing    prometheus.Gauge
+	lost       prometheus.Gauge
+
+	churned      prometheus.Counter
+	setupLatency prometheus.Histogram
+
+	sessionsServed *prometheus.CounterVec
+	requestErrors  *prometheus.CounterVec
+
+	latency       prometheus.Histogram
+	latencyByNode *prometheus.HistogramVec
+	postLatency   *prometheus.HistogramVec
+
+	traceReplayed prometheus.Counter
+	traceDropped  prometheus.Counter
+}
+
+// nativeHistogramMaxBuckets bounds the number of buckets of a native
+// latency histogram. Once exceeded, the resolution is reduced.
+const nativeHistogramMaxBuckets = 160
+
+// newMetrics creates the collectors. buckets are the bucket bounds (in
+// seconds) of the latency histograms, which are native histograms if
+// nativeFactor is greater than 1 (see Options).
+func newMetrics(buckets []float64, nativeFactor float64) *metrics {
+	latencyOpts := func(name, help string) prometheus.HistogramOpts {
+		opts := prometheus.HistogramOpts{
+			Name:    name,
+			Help:    help,
+			Buckets: buckets,
+		}
+		if nativeFactor > 1 {
+			opts.NativeHistogramBucketFactor = nativeFactor
+			opts.NativeHistogramMaxBucketNumber = nativeHistogramMaxBuckets
+		}
+		return opts
+	}
+	return &metrics{
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_sent",
+			Help: "Number of PRIVMSGs sent",
+		}),
+
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_received",
+			Help: "Number of PRIVMSGs received",
+		}),
+
+		spread: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "spread",
+			Help: "Spread between minimum/maximum number of messages/s within the last 10s",
+		}),
+
+		sessionsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sessions_active",
+			Help: "Number of sessions which are currently set up",
+		}),
+
+		sessionErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "session_errors_total",
+				Help: "Number of sessions which failed, by the server the session was created on",
+			},
+			[]string{"server"}),
+
+		setupDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "setup_duration_seconds",
+			Help: "Time it took until all sessions were registered and joined their channels",
+		}),
+
+		duplicated: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_duplicated",
+			Help: "Number of PRIVMSGs received more than once",
+		}),
+
+		reordered: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_reordered",
+			Help: "Number of PRIVMSGs received after a PRIVMSG with a higher sequence number from the same sender",
+		}),
+
+		missing: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "messages_missing",
+			Help: "Number of sequence number gaps which are currently outstanding (lost or not yet received)",
+		}),
+
+		lost: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "messages_lost",
+			Help: "Number of PRIVMSGs which were sent but never received. Only set at the end of the run.",
+		}),
+
+		churned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sessions_churned",
+			Help: "Number of sessions which were deleted and recreated by the churn workload",
+		}),
+
+		setupLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "session_setup_latency",
+			Help:    "Latency (in s) between creating a session and the session having joined its channels",
+			Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+		}),
+
+		sessionsServed: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "sessions_served",
+				Help: "Number of sessions created, by the server they were sent to and the server which handled the creation (the leader, if the request was proxied)",
+			},
+			[]string{"server", "handler"}),
+
+		requestErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "request_errors_total",
+				Help: "Number of failed requests to RobustIRC servers (including requests which were retried), by server",
+			},
+			[]string{"server"}),
+
+		latency: prometheus.NewHistogram(latencyOpts(
+			"message_latency_seconds",
+			"Latency between the point when the message was sent and when it was received")),
+
+		latencyByNode: prometheus.NewHistogramVec(
+			latencyOpts(
+				"message_latency_by_node_seconds",
+				"Like message_latency_seconds, by the server the message was posted to and the server the receiving session was streaming from"),
+			[]string{"post_server", "receive_server"}),
+
+		postLatency: prometheus.NewHistogramVec(
+			latencyOpts(
+				"post_latency_seconds",
+				"Duration of PostMessage requests, by the server they were sent to and the server which handled them (the leader, if the request was proxied)"),
+			[]string{"server", "handler"}),
+
+		traceReplayed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "trace_events_replayed",
+			Help: "Number of trace events which were handed to a sending session",
+		}),
+
+		traceDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "trace_events_dropped",
+			Help: "Number of trace events which were dropped because the session’s backlog was full",
+		}),
+	}
+}
+
+func (m *metrics) register(reg prometheus.Registerer) {
+	reg.MustRegister(
+		m.sent,
+		m.received,
+		m.spread,
+		m.sessionsActive,
+		m.sessionErrors,
+		m.setupDuration,
+		m.duplicated,
+		m.reordered,
+		m.missing,
+		m.lost,
+		m.churned,
+		m.setupLatency,
+		m.sessionsServed,
+		m.requestErrors,
+		m.latency,
+		m.latencyByNode,
+		m.postLatency,
+		m.traceReplayed,
+		m.traceDropped)
+}
@@ -0,0 +1,152 @@
+package load
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/trace"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// replayBacklog is the number of trace events which can be queued per
+// session. Events for a session whose backlog is full are dropped, so
+// that a slow session does not delay the replay of all other sessions.
+const replayBacklog = 64
+
+// maxMessageSize is the maximum size of an IRC message, excluding the
+// trailing CR-LF.
+const maxMessageSize = 510
+
+// benchMessage returns the message which session idx sends for payload.
+// When replaying a trace, ev determines the command and the size (the
+// payload is padded).
+func (r *Runner) benchMessage(idx int, payload benchPayload, ev *trace.Event) string {
+	command := irc.PRIVMSG
+	if ev != nil && ev.Command == irc.NOTICE {
+		command = irc.NOTICE
+	}
+	msg := fmt.Sprintf("%s %s :%s", command, r.channel(idx%r.opts.Channels), payload)
+	if ev != nil {
+		size := ev.Size
+		if size > maxMessageSize {
+			size = maxMessageSize
+		}
+		if padding := size - len(msg) - 1; padding > 0 {
+			msg += " " + strings.Repeat("x", padding)
+		}
+	}
+	return msg + "\r\n"
+}
+
+// replayable returns whether ev can be replayed. Only messages are
+// replayed, as all other commands (JOIN, NICK, …) would interfere with
+// the benchmark’s channel setup.
+func replayable(ev *trace.Event) bool {
+	return ev.Command == irc.PRIVMSG || ev.Command == irc.NOTICE
+}
+
+// replayMapping maps trace sessions and channels to the sending sessions
+// of g. Since sessions can only send to the channel they joined (see
+// setupSession), each trace channel is mapped to a bench channel, and
+// the trace session to one of the members of that bench channel.
+type replayMapping struct {
+	members [][]int // sending sessions per bench channel
+}
+
+func newReplayMapping(g *sessionGroup, channels int) *replayMapping {
+	m := &replayMapping{members: make([][]int, channels)}
+	for idx := g.first; idx < g.first+g.count; idx++ {
+		if idx == 0 {
+			continue
+		}
+		channel := idx % channels
+		m.members[channel] = append(m.members[channel], idx)
+	}
+	return m
+}
+
+// session returns the session which replays ev, or -1 if there is none.
+func (m *replayMapping) session(ev *trace.Event) int {
+	channel := ev.Channel
+	if channel < 0 {
+		// Messages which were not sent to a channel are sent to the
+		// channel of the sending session.
+		channel = ev.Session
+	}
+	members := m.members[channel%len(m.members)]
+	if len(members) == 0 {
+		return -1
+	}
+	return members[ev.Session%len(members)]
+}
+
+// replay hands the events of Options.Trace to the sessions of g at
+// Options.TraceSpeed.
+type replay struct {
+	mapping *replayMapping
+	due     chan *trace.Event
+	stop    chan struct{}
+
+	replayed, skipped, dropped uint64
+}
+
+func (r *Runner) startReplay(g *sessionGroup) *replay {
+	events := r.opts.Trace
+	speed := r.opts.TraceSpeed
+	if speed <= 0 {
+		speed = 1
+	}
+	var duration time.Duration
+	if len(events) > 0 {
+		duration = events[len(events)-1].Offset
+	}
+	log.Printf("Replaying %d events (%v) at %vx speed", len(events), duration, speed)
+
+	rp := &replay{
+		mapping: newReplayMapping(g, r.opts.Channels),
+		due:     make(chan *trace.Event),
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		defer close(rp.due)
+		start := time.Now()
+		for i := range events {
+			ev := &events[i]
+			offset := time.Duration(float64(ev.Offset) / speed)
+			time.Sleep(time.Until(start.Add(offset)))
+			select {
+			case rp.due <- ev:
+			case <-rp.stop:
+				return
+			}
+		}
+	}()
+	return rp
+}
+
+// send hands ev to the session which replays it. Events for a session
+// whose backlog is full are dropped.
+func (rp *replay) send(r *Runner, g *sessionGroup, ev *trace.Event) {
+	session := -1
+	if replayable(ev) {
+		session = rp.mapping.session(ev)
+	}
+	if session == -1 {
+		rp.skipped++
+		return
+	}
+	select {
+	case g.own[session-g.first] <- token{event: ev}:
+		rp.replayed++
+		r.metrics.traceReplayed.Inc()
+	default:
+		rp.dropped++
+		r.metrics.traceDropped.Inc()
+	}
+}
+
+func (rp *replay) logReport(prefix string) {
+	log.Printf("%s: %d events replayed, %d skipped (not a message), %d dropped (session backlog full)", prefix, rp.replayed, rp.skipped, rp.dropped)
+}
@@ -0,0 +1,529 @@
+package load
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/robustirc/benchmark/internal/robustclient"
+	"github.com/robustirc/benchmark/internal/trace"
+	"gopkg.in/sorcix/irc.v2"
+)
+
+// token is used for throttling. When replaying a trace, it also
+// carries the event which determines the message to send.
+type token struct {
+	event *trace.Event
+}
+
+// sessionOptions returns the options for session idx according to
+// Options.ServerSelection.
+func (r *Runner) sessionOptions(idx int) robustclient.Options {
+	servers := r.opts.Servers
+	opts := robustclient.Options{Servers: servers}
+	switch r.opts.ServerSelection {
+	case "", "failover":
+		opts.FollowLeader = true
+	case "round-robin":
+		opts.Target = servers[idx%len(servers)]
+	case "random":
+		opts.Target = servers[rand.Intn(len(servers))]
+	case "pinned":
+		opts.Target = servers[idx%len(servers)]
+		opts.Pinned = true
+	}
+	return opts
+}
+
+// createSession creates a RobustIRC session for session idx and records
+// which server handled it.
+func (r *Runner) createSession(idx int) (*robustclient.Session, error) {
+	opts := r.sessionOptions(idx)
+	opts.Client = r.sharedClient
+	opts.Transport = r.opts.Transport
+	opts.RequestFailed = func(server string, err error) {
+		r.metrics.requestErrors.WithLabelValues(server).Inc()
+		atomic.AddUint64(&r.stats.requestErrors, 1)
+	}
+	session, err := robustclient.Create(opts)
+	if err != nil {
+		return nil, err
+	}
+	served := session.Served()
+	if served.ProxiedTo != "" {
+		log.Printf("session %d created on %s (proxied to %s)", idx, served.Server, served.ProxiedTo)
+	} else {
+		log.Printf("session %d created on %s", idx, served.Server)
+	}
+	r.metrics.sessionsServed.WithLabelValues(served.Server, served.Handler()).Inc()
+	if r.opts.SessionCreated != nil {
+		r.opts.SessionCreated(served)
+	}
+	return session, nil
+}
+
+// channel returns the name of bench channel idx.
+func (r *Runner) channel(idx int) string {
+	return fmt.Sprintf("#%s-%d", r.opts.Prefix, idx)
+}
+
+// setupSession registers session idx and joins its channels. It
+// returns once the network confirmed the registration (RPL_WELCOME)
+// and all JOINs (RPL_ENDOFNAMES), or ctx is done.
+func (r *Runner) setupSession(ctx context.Context, session *robustclient.Session, idx int) error {
+	var channels []string
+	if idx == 0 {
+		for j := 0; j < r.opts.Channels; j++ {
+			channels = append(channels, r.channel(j))
+		}
+	} else {
+		channels = append(channels, r.channel(idx%r.opts.Channels))
+	}
+
+	post := func(msg string) error {
+		log.Printf("-> %s\n", msg)
+		return session.PostMessage(msg)
+	}
+
+	nick := fmt.Sprintf("%s-%d", r.opts.Prefix, idx)
+	if err := post(fmt.Sprintf("NICK %s\r\n", nick)); err != nil {
+		return err
+	}
+	if err := post(fmt.Sprintf("USER %s 0 * :%s\r\n", r.opts.Prefix, r.opts.Prefix)); err != nil {
+		return err
+	}
+
+	var (
+		collisions int
+		joined     int
+	)
+	for {
+		select {
+		case msg := <-session.Messages:
+			ircmsg := irc.ParseMessage(msg)
+			if ircmsg == nil {
+				continue
+			}
+			switch ircmsg.Command {
+			case irc.ERR_NICKNAMEINUSE:
+				// The nick is taken, e.g. because a previous benchmark is
+				// still running or a failed session was not yet deleted.
+				collisions++
+				nick = fmt.Sprintf("%s-%d-%d", r.opts.Prefix, idx, collisions)
+				if err := post(fmt.Sprintf("NICK %s\r\n", nick)); err != nil {
+					return err
+				}
+
+			case irc.RPL_WELCOME:
+				for _, channel := range channels {
+					if err := post(fmt.Sprintf("JOIN %s\r\n", channel)); err != nil {
+						return err
+					}
+				}
+
+			case irc.RPL_ENDOFNAMES:
+				if joined++; joined == len(channels) {
+					log.Printf("session %d set up as %q", idx, nick)
+					return nil
+				}
+			}
+
+		case err := <-session.Errors:
+			return err
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// workerState is the state of a session which is carried over when the
+// session is recreated, see superviseWorker.
+type workerState struct {
+	// seq is the last sequence number used by the session.
+	seq uint64
+
+	// server is the server the session was last created on, or empty if
+	// creating the session failed.
+	server string
+}
+
+// runWorker runs session idx until it fails, stop is closed (the
+// session was removed) or ctx is done (all sessions are shut down).
+// ready is called once the session is set up.
+func (r *Runner) runWorker(ctx context.Context, tokens, own <-chan token, stop <-chan struct{}, idx int, state *workerState, ready func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Printf("initializing session %d", idx)
+	created := time.Now()
+
+	state.server = ""
+	session, err := r.createSession(idx)
+	if err != nil {
+		return fmt.Errorf("Could not create session: %v", err)
+	}
+	state.server = session.Served().Server
+	churn := r.churner.signal(idx)
+	r.metrics.sessionsActive.Inc()
+	atomic.AddInt64(&r.stats.sessionsActive, 1)
+	defer func() {
+		r.metrics.sessionsActive.Dec()
+		atomic.AddInt64(&r.stats.sessionsActive, -1)
+	}()
+
+	var (
+		done    = make(chan struct{})
+		sendErr = make(chan error, 1)
+		wg      sync.WaitGroup
+
+		quitMessage = "session failed"
+	)
+	defer func() {
+		close(done)
+		if ctx.Err() != nil {
+			quitMessage = "benchmark finished"
+		}
+		// Delete the session so that its nickname is freed up for a
+		// recreated session, and so that a blocked PostMessage returns.
+		if err := session.Delete(quitMessage); err != nil {
+			log.Printf("session %d: Delete: %v", idx, err)
+		}
+		wg.Wait()
+	}()
+
+	if err := r.setupSession(ctx, session, idx); err != nil {
+		return err
+	}
+	r.metrics.setupLatency.Observe(time.Since(created).Seconds())
+	ready()
+
+	// The first session only receives messages, see Options.Sessions.
+	if idx != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				// Read a token to block this goroutine until we should
+				// send again. This throttles our sending speed.
+				var t token
+				select {
+				case t = <-tokens:
+				case t = <-own:
+				case <-done:
+					return
+				}
+				payload := benchPayload{
+					Sender: idx,
+					Seq:    state.seq + 1,
+					Sent:   r.now().UnixNano(),
+				}
+				target := session.Target()
+				posted := time.Now()
+				r.sendTimes.record(idx, payload.Seq, posted, target)
+				served, err := session.Post(r.benchMessage(idx, payload, t.event))
+				if err != nil {
+					r.sendTimes.forget(idx, payload.Seq)
+					sendErr <- fmt.Errorf("PostMessage: %v", err)
+					return
+				}
+				r.observePostLatency(served, time.Since(posted))
+				if served.Server != target {
+					r.sendTimes.setServer(idx, payload.Seq, served.Server)
+				}
+				state.seq = payload.Seq
+				r.accounting.sent(idx, payload.Seq)
+				atomic.AddUint64(&r.stats.sent, 1)
+			}
+		}()
+	}
+
+	for {
+		select {
+		case msg := <-session.Messages:
+			received := time.Now()
+			// Only parse each message once.
+			if idx != 0 {
+				continue
+			}
+
+			ircmsg := irc.ParseMessage(msg)
+			if ircmsg == nil {
+				continue
+			}
+
+			atomic.AddUint64(&r.stats.received, 1)
+
+			if ircmsg.Command != irc.PRIVMSG && ircmsg.Command != irc.NOTICE {
+				continue
+			}
+
+			payload, err := parseBenchPayload(ircmsg.Trailing())
+			if err != nil {
+				continue
+			}
+			r.accounting.received(payload)
+
+			latency, postServer := r.messageLatencyOf(payload, received)
+			r.observeLatency(latency)
+			r.observeNodeLatency(postServer, session.Streaming(), latency)
+
+		case err := <-session.Errors:
+			return err
+
+		case err := <-sendErr:
+			return err
+
+		case <-churn:
+			quitMessage = "churn"
+			return errChurned
+
+		case <-stop:
+			quitMessage = "removed"
+			return errStopped
+
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// superviseWorker runs session idx, recreating it with exponential
+// backoff if Options.Reconnect is set. Once the session is considered
+// dead, idx is sent to dead. ready is called once the session was set up
+// for the first time, or when it died before that. Once stop is closed
+// or ctx is done, the session is deleted and superviseWorker returns.
+func (r *Runner) superviseWorker(ctx context.Context, tokens, own <-chan token, stop <-chan struct{}, idx int, dead chan<- int, ready func()) {
+	var readyOnce sync.Once
+	setUp := func() { readyOnce.Do(ready) }
+	defer setUp()
+	const (
+		initialBackoff = 1 * time.Second
+		maxBackoff     = 1 * time.Minute
+	)
+	var (
+		state      workerState
+		reconnects int
+		backoff    = initialBackoff
+	)
+	for {
+		started := time.Now()
+		err := r.runWorker(ctx, tokens, own, stop, idx, &state, setUp)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errChurned {
+			r.metrics.churned.Inc()
+			continue
+		}
+		if err == errStopped {
+			log.Printf("session %d removed", idx)
+			return
+		}
+		r.metrics.sessionErrors.WithLabelValues(nodeLabel(state.server)).Inc()
+		atomic.AddUint64(&r.stats.sessionErrors, 1)
+		log.Printf("session %d failed: %v", idx, err)
+		if !r.opts.Reconnect || reconnects >= r.opts.MaxReconnects {
+			log.Printf("session %d is dead", idx)
+			select {
+			case dead <- idx:
+			case <-stop:
+			case <-ctx.Done():
+			}
+			return
+		}
+		// A session which was healthy for longer than the maximum
+		// backoff is not flapping, so start over.
+		if time.Since(started) > maxBackoff {
+			backoff = initialBackoff
+		}
+		reconnects++
+		log.Printf("recreating session %d in %v (reconnect %d of %d)", idx, backoff, reconnects, r.opts.MaxReconnects)
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			log.Printf("session %d removed", idx)
+			return
+		case <-ctx.Done():
+			return
+		}
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// sessionGroup is the range of sessions run by a Runner: all sessions
+// when running standalone, a subset when running as agent. It is only
+// used by the goroutine which runs the Runner.
+type sessionGroup struct {
+	runner       *Runner
+	first, count int
+
+	// ctx is canceled by close to shut down all sessions. wg tracks all
+	// sessions until they were deleted.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	tokens chan token
+	// own contains a token channel per session which is used to send
+	// tokens to a specific session, see Runner.replay.
+	own []chan token
+	// stop contains a channel per session which is closed to remove the
+	// session, see removeSessions.
+	stop         []chan struct{}
+	dead         chan int
+	deadSessions int
+
+	// gone is true for the sessions which died or were removed.
+	gone    []bool
+	removed int
+}
+
+// sending returns the number of sending sessions in g.
+func (g *sessionGroup) sending() int {
+	if g.first == 0 && g.count > 0 {
+		return g.count - g.removed - 1
+	}
+	return g.count - g.removed
+}
+
+// startSession starts session idx, which must be the next session of g.
+func (g *sessionGroup) startSession(idx int, ready func()) {
+	own := make(chan token, replayBacklog)
+	stop := make(chan struct{})
+	g.own = append(g.own, own)
+	g.stop = append(g.stop, stop)
+	g.gone = append(g.gone, false)
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.runner.superviseWorker(g.ctx, g.tokens, own, stop, idx, g.dead, ready)
+	}()
+}
+
+// addSessions starts n more sending sessions. Their indices follow all
+// sessions ever started, so that they do not clash with removed
+// sessions which are still being deleted.
+func (g *sessionGroup) addSessions(n int) {
+	g.runner.churner.add(n)
+	for i := 0; i < n; i++ {
+		g.startSession(g.first+g.count, func() {})
+		g.count++
+	}
+}
+
+// removeSessions stops the n most recently started sending sessions,
+// but always keeps at least one. It returns the number of sessions which
+// were removed.
+func (g *sessionGroup) removeSessions(n int) int {
+	removed := 0
+	for i := g.count - 1; i >= 0 && removed < n && g.sending() > 1; i-- {
+		if g.gone[i] || g.first+i == 0 {
+			continue
+		}
+		close(g.stop[i])
+		g.gone[i] = true
+		g.removed++
+		removed++
+	}
+	return removed
+}
+
+// close shuts down all sessions which are still running, see wait.
+func (g *sessionGroup) close() {
+	if g.cancel != nil {
+		g.cancel()
+	}
+	for i := range g.gone {
+		g.gone[i] = true
+	}
+}
+
+// wait returns once all sessions were deleted, or ctx is done.
+func (g *sessionGroup) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *sessionGroup) handleDead(idx int) error {
+	if idx == 0 {
+		return fmt.Errorf("receiving session died")
+	}
+	g.gone[idx-g.first] = true
+	g.deadSessions++
+	if g.deadSessions >= g.sending() {
+		return fmt.Errorf("all %d sending sessions died", g.sending())
+	}
+	max := g.runner.opts.MaxDeadSessions
+	if fraction := float64(g.deadSessions) / float64(g.sending()); fraction > max {
+		return fmt.Errorf("%d of %d sending sessions died, more than the maximum of %v", g.deadSessions, g.sending(), max)
+	}
+	return nil
+}
+
+// startSessions starts the sessions [first, first+count) and returns
+// once all of them are set up (or dead).
+func (r *Runner) startSessions(ctx context.Context, first, count int) (*sessionGroup, error) {
+	// The sessions outlive ctx, which only bounds the setup.
+	sessionCtx, cancel := context.WithCancel(context.Background())
+	g := &sessionGroup{
+		runner: r,
+		first:  first,
+		count:  count,
+		ctx:    sessionCtx,
+		cancel: cancel,
+		tokens: make(chan token),
+		dead:   make(chan int),
+	}
+
+	var setupWg sync.WaitGroup
+	setupStarted := time.Now()
+	setupWg.Add(count)
+	for i := first; i < first+count; i++ {
+		g.startSession(i, setupWg.Done)
+	}
+	setupDone := make(chan struct{})
+	go func() {
+		setupWg.Wait()
+		close(setupDone)
+	}()
+	setupTimer := time.NewTimer(r.opts.SetupTimeout)
+	defer setupTimer.Stop()
+setup:
+	for {
+		select {
+		case <-setupDone:
+			break setup
+		case idx := <-g.dead:
+			if err := g.handleDead(idx); err != nil {
+				g.close()
+				return nil, err
+			}
+		case <-setupTimer.C:
+			g.close()
+			return nil, fmt.Errorf("sessions were not set up within %v", r.opts.SetupTimeout)
+		case <-ctx.Done():
+			g.close()
+			return nil, ctx.Err()
+		}
+	}
+	setupDuration := time.Since(setupStarted)
+	log.Printf("All %d sessions set up in %v", count, setupDuration)
+	r.RecordSetupDuration(setupDuration)
+	return g, nil
+}
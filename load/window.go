@@ -0,0 +1,51 @@
+package load
+
+// convergenceWindow is the number of seconds over which convergence is
+// determined.
+const convergenceWindow = 10
+
+// window holds the values of the last len(values) seconds, e.g. the
+// number of messages received per second.
+type window struct {
+	values []uint64
+	next   int // index of the oldest value
+	filled int // number of values added, up to len(values)
+}
+
+func newWindow(size int) *window {
+	return &window{values: make([]uint64, size)}
+}
+
+// add replaces the oldest value with v.
+func (w *window) add(v uint64) {
+	w.values[w.next] = v
+	w.next = (w.next + 1) % len(w.values)
+	if w.filled < len(w.values) {
+		w.filled++
+	}
+}
+
+// min returns the lowest value, or 0 if no values were added.
+func (w *window) min() uint64 {
+	if w.filled == 0 {
+		return 0
+	}
+	min := ^uint64(0) // max uint64 value
+	for _, v := range w.values[:w.filled] {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// max returns the highest value, or 0 if no values were added.
+func (w *window) max() uint64 {
+	var max uint64
+	for _, v := range w.values[:w.filled] {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
@@ -38,7 +38,7 @@ func main() {
 	flag.Parse()
 
 	if *numSessions < 2 {
-		log.Fatal("-sessions needs to be 2 or higher (specified %d)", *numSessions)
+		log.Fatalf("-sessions needs to be 2 or higher (specified %d)", *numSessions)
 	}
 
 	// TODO(secure): verify that cpu governor is on performance
@@ -100,7 +100,7 @@ func main() {
 				continue
 			}
 			var bm benchmessage
-			if err := json.Unmarshal([]byte(msg.Trailing), &bm); err != nil {
+			if err := json.Unmarshal([]byte(msg.Trailing()), &bm); err != nil {
 				log.Fatal(err)
 			}
 			latencies[int(bm.Num)] = latency